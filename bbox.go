@@ -0,0 +1,605 @@
+package main
+
+import (
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// matrix is a PDF transformation matrix [a b c d e f].
+type matrix [6]float64
+
+var identityMatrix = matrix{1, 0, 0, 1, 0, 0}
+
+// mul returns the matrix applying m followed by n.
+func (m matrix) mul(n matrix) matrix {
+	return matrix{
+		m[0]*n[0] + m[1]*n[2],
+		m[0]*n[1] + m[1]*n[3],
+		m[2]*n[0] + m[3]*n[2],
+		m[2]*n[1] + m[3]*n[3],
+		m[4]*n[0] + m[5]*n[2] + n[4],
+		m[4]*n[1] + m[5]*n[3] + n[5],
+	}
+}
+
+func (m matrix) apply(x, y float64) (float64, float64) {
+	return m[0]*x + m[2]*y + m[4], m[1]*x + m[3]*y + m[5]
+}
+
+// bbox accumulates the bounding box of points.
+type bbox struct {
+	r     rect
+	empty bool
+}
+
+func newBBox() *bbox {
+	return &bbox{empty: true}
+}
+
+func (b *bbox) add(x, y float64) {
+	if b.empty {
+		b.r = rect{x, y, x, y}
+		b.empty = false
+		return
+	}
+	if x < b.r.llx {
+		b.r.llx = x
+	}
+	if y < b.r.lly {
+		b.r.lly = y
+	}
+	if x > b.r.urx {
+		b.r.urx = x
+	}
+	if y > b.r.ury {
+		b.r.ury = y
+	}
+}
+
+// addRect adds the corners of r transformed by m.
+func (b *bbox) addRect(r rect, m matrix) {
+	b.add(m.apply(r.llx, r.lly))
+	b.add(m.apply(r.urx, r.lly))
+	b.add(m.apply(r.llx, r.ury))
+	b.add(m.apply(r.urx, r.ury))
+}
+
+// contentToken is a lexical token of a content stream. Arrays and
+// dictionaries are collapsed into a single token each.
+type contentToken struct {
+	kind byte    // one of the token kinds below
+	num  float64 // value of a number
+	str  string  // value of a name
+	// number of characters of a string and how many of them are spaces
+	chars, spaces int
+	// elements of an array
+	elems []contentToken
+}
+
+// Kinds of content tokens
+const (
+	tokenOther  = iota // true, false, null and dictionaries
+	tokenNum           // numbers
+	tokenName          // names
+	tokenString        // literal and hex strings
+	tokenArray         // arrays
+)
+
+// lexContent splits the content stream s into tokens, calling fn with
+// each operator and its operands. Inline image data is skipped.
+func lexContent(s string, fn func(op string, args []contentToken) error) error {
+	var args []contentToken
+	// start of the operands of the open arrays and dictionaries
+	var nested []int
+	collapse := func(kind byte) {
+		start := nested[len(nested)-1]
+		nested = nested[:len(nested)-1]
+		t := contentToken{kind: kind}
+		if kind == tokenArray {
+			t.elems = append([]contentToken{}, args[start:]...)
+		}
+		args = append(args[:start], t)
+	}
+	isDelim := func(c byte) bool {
+		return strings.IndexByte("()<>[]{}/%", c) >= 0
+	}
+	isSpace := func(c byte) bool {
+		return strings.IndexByte(" \t\r\n\f\x00", c) >= 0
+	}
+	isOctal := func(c byte) bool {
+		return c >= '0' && c <= '7'
+	}
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case isSpace(c):
+			i++
+		case c == '%':
+			for i < len(s) && s[i] != '\n' && s[i] != '\r' {
+				i++
+			}
+		case c == '(':
+			t, depth := contentToken{kind: tokenString}, 0
+			for i++; i < len(s); i++ {
+				ch := s[i]
+				if ch == '\\' && i+1 < len(s) {
+					i++
+					ch = s[i]
+					if isOctal(ch) {
+						// Up to 3 octal digits make up one character
+						v := 0
+						for j := 0; j < 3 && i < len(s) && isOctal(s[i]); j++ {
+							v = v*8 + int(s[i]-'0')
+							i++
+						}
+						i--
+						ch = byte(v)
+					}
+				} else if ch == '(' {
+					depth++
+				} else if ch == ')' {
+					if depth == 0 {
+						break
+					}
+					depth--
+				}
+				t.chars++
+				if ch == ' ' {
+					t.spaces++
+				}
+			}
+			i++
+			args = append(args, t)
+		case c == '<' && i+1 < len(s) && s[i+1] == '<':
+			nested = append(nested, len(args))
+			i += 2
+		case c == '>' && i+1 < len(s) && s[i+1] == '>':
+			if len(nested) > 0 {
+				collapse(tokenOther)
+			}
+			i += 2
+		case c == '<':
+			j := strings.IndexByte(s[i:], '>')
+			if j < 0 {
+				return fmt.Errorf("unterminated hex string in content")
+			}
+			hex := strings.Map(func(r rune) rune {
+				if isSpace(byte(r)) {
+					return -1
+				}
+				return r
+			}, s[i+1:i+j])
+			t := contentToken{kind: tokenString, chars: (len(hex) + 1) / 2}
+			for k := 0; k+1 < len(hex); k += 2 {
+				if hex[k:k+2] == "20" {
+					t.spaces++
+				}
+			}
+			args = append(args, t)
+			i += j + 1
+		case c == '[':
+			nested = append(nested, len(args))
+			i++
+		case c == ']':
+			if len(nested) > 0 {
+				collapse(tokenArray)
+			}
+			i++
+		case c == '{' || c == '}':
+			i++
+		default:
+			j := i + 1
+			if c == '/' {
+				i++
+			}
+			for j < len(s) && !isSpace(s[j]) && !isDelim(s[j]) {
+				j++
+			}
+			tok := s[i:j]
+			i = j
+			if c == '/' {
+				args = append(args, contentToken{kind: tokenName, str: tok})
+				continue
+			}
+			if f, err := strconv.ParseFloat(tok, 64); err == nil {
+				args = append(args, contentToken{kind: tokenNum, num: f})
+				continue
+			}
+			if len(nested) > 0 {
+				// true, false and null within arrays and dictionaries
+				args = append(args, contentToken{})
+				continue
+			}
+			if err := fn(tok, args); err != nil {
+				return err
+			}
+			args = args[:0]
+			if tok == "ID" {
+				// Skip inline image data up to EI on its own
+				m := regexp.MustCompile(`[ \t\r\n\f\x00]EI(?:[ \t\r\n\f\x00]|$)`).FindStringIndex(s[i:])
+				if m == nil {
+					return fmt.Errorf("unterminated inline image in content")
+				}
+				i += m[1]
+				if err := fn("EI", nil); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// streamData returns the decoded data of the stream object id.
+func streamData(d string, id int) (string, error) {
+	m := regexp.MustCompile(fmt.Sprintf(`(?ms)^%d 0 obj\n<<(.*?)>>\s*stream\r?\n(.*?)endstream\s*endobj`, id)).FindStringSubmatch(d)
+	if m == nil {
+		return "", fmt.Errorf("cannot find stream %d", id)
+	}
+	return decodeStream(m[1], m[2])
+}
+
+// decodeStream returns the decoded data of a stream given the body of
+// its dictionary. Only unfiltered and plain Flate streams are supported,
+// which covers nearly all content streams.
+func decodeStream(dict, data string) (string, error) {
+	m := regexp.MustCompile(`/Filter\s*(?:\[\s*/(\w+)\s*\]|/(\w+))`).FindStringSubmatch(dict)
+	if m == nil {
+		if strings.Contains(dict, "/Filter") {
+			return "", errUnknownExtent
+		}
+		return data, nil
+	}
+	if m[1]+m[2] != "FlateDecode" || strings.Contains(dict, "/DecodeParms") {
+		return "", errUnknownExtent
+	}
+	r, err := zlib.NewReader(strings.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// errUnknownExtent is returned when the extent of what content paints
+// can't be worked out.
+var errUnknownExtent = fmt.Errorf("unknown extent of content")
+
+// contentBBox returns the bounding box of what the content streams of
+// the page paint, in the default coordinates of the page. It errs on
+// the side of a larger box: clipping is ignored, curves are bound by
+// their control points and glyphs are assumed to be at most 1em wide.
+// It fails if the content is in streams with filters other than Flate,
+// or paints in ways whose extent isn't known, such as shadings.
+func contentBBox(d string, p *page) (rect, error) {
+	b := &strings.Builder{}
+	for _, id := range p.contentIds {
+		data, err := streamData(d, id)
+		if err != nil {
+			return rect{}, err
+		}
+		// Streams of a page are concatenated at token boundaries
+		b.WriteString(data)
+		b.WriteString("\n")
+	}
+	return streamBBox(d, b.String(), p.raw, identityMatrix, map[int]bool{})
+}
+
+// graphicsState is the part of the graphics state streamBBox needs, as
+// saved by q and restored by Q.
+type graphicsState struct {
+	ctm       matrix
+	lineWidth float64
+	// text state
+	fontSize, leading, hScale, charSpacing, wordSpacing, rise float64
+}
+
+// streamBBox returns the bounding box of what the content stream s paints
+// using the resources in the dictionary body dict, transformed by ctm.
+func streamBBox(d, s, dict string, ctm matrix, seen map[int]bool) (rect, error) {
+	box := newBBox()
+	gs := graphicsState{ctm: ctm, lineWidth: 1, hScale: 1}
+	var stack []graphicsState
+	var path []float64
+	var tm, tlm matrix
+	// Range of where the text position may be along the line since tm
+	// was last set, as the widths of glyphs aren't known
+	var tlo, thi float64
+
+	num := func(args []contentToken, n int) []float64 {
+		if len(args) < n {
+			return nil
+		}
+		f := make([]float64, n)
+		for i, a := range args[len(args)-n:] {
+			f[i] = a.num
+		}
+		return f
+	}
+	showText := func(t contentToken) error {
+		elems := []contentToken{t}
+		if t.kind == tokenArray {
+			elems = t.elems
+		}
+		em := gs.fontSize * gs.hScale
+		// Each character moves the text position by its width, from 0 to
+		// 1em, plus the character spacing, and spaces also by the word
+		// spacing
+		step0, step1 := gs.charSpacing*gs.hScale, (gs.fontSize+gs.charSpacing)*gs.hScale
+		if step0 > step1 {
+			step0, step1 = step1, step0
+		}
+		space := gs.wordSpacing * gs.hScale
+		minX, maxX := math.Inf(1), math.Inf(-1)
+		for _, e := range elems {
+			switch e.kind {
+			case tokenNum:
+				// Adjustments in thousandths of an em move glyphs back
+				tlo -= e.num / 1000 * em
+				thi -= e.num / 1000 * em
+			case tokenString:
+				c, sp := float64(e.chars), float64(e.spaces)
+				if e.chars > 0 {
+					minX = math.Min(minX, tlo+(c-1)*math.Min(step0, 0)+sp*math.Min(space, 0))
+					maxX = math.Max(maxX, thi+(c-1)*math.Max(step1, 0)+sp*math.Max(space, 0))
+				}
+				tlo += c*step0 + sp*space
+				thi += c*step1 + sp*space
+			default:
+				return errUnknownExtent
+			}
+		}
+		if minX > maxX {
+			// No characters shown
+			return nil
+		}
+		// Glyphs reach up to 1em from where they're placed
+		minX -= math.Max(-em, 0)
+		maxX += math.Max(em, 0)
+		box.addRect(rect{minX, gs.rise - gs.fontSize/4, maxX, gs.rise + gs.fontSize}, tm.mul(gs.ctm))
+		return nil
+	}
+	nextLine := func(tx, ty float64) {
+		tlm = matrix{1, 0, 0, 1, tx, ty}.mul(tlm)
+		tm = tlm
+		tlo, thi = 0, 0
+	}
+
+	err := lexContent(s, func(op string, args []contentToken) error {
+		switch op {
+		case "q":
+			stack = append(stack, gs)
+		case "Q":
+			if len(stack) > 0 {
+				gs, stack = stack[len(stack)-1], stack[:len(stack)-1]
+			}
+		case "cm":
+			if f := num(args, 6); f != nil {
+				gs.ctm = matrix{f[0], f[1], f[2], f[3], f[4], f[5]}.mul(gs.ctm)
+			}
+		case "w":
+			if f := num(args, 1); f != nil {
+				gs.lineWidth = f[0]
+			}
+		case "m", "l", "c", "v", "y":
+			for i := 0; i+1 < len(args); i += 2 {
+				x, y := gs.ctm.apply(args[i].num, args[i+1].num)
+				path = append(path, x, y)
+			}
+		case "re":
+			if f := num(args, 4); f != nil {
+				for _, c := range [][2]float64{{0, 0}, {f[2], 0}, {0, f[3]}, {f[2], f[3]}} {
+					x, y := gs.ctm.apply(f[0]+c[0], f[1]+c[1])
+					path = append(path, x, y)
+				}
+			}
+		case "S", "s", "B", "B*", "b", "b*":
+			// Grow the box by the line width in the most stretched
+			// direction of the ctm
+			ctm := gs.ctm
+			scale := math.Max(
+				math.Abs(ctm[0])+math.Abs(ctm[2]),
+				math.Abs(ctm[1])+math.Abs(ctm[3]))
+			hw := gs.lineWidth * scale / 2
+			if gs.lineWidth == 0 {
+				hw = 1
+			}
+			for i := 0; i+1 < len(path); i += 2 {
+				box.addRect(rect{path[i] - hw, path[i+1] - hw, path[i] + hw, path[i+1] + hw}, identityMatrix)
+			}
+			path = path[:0]
+		case "f", "F", "f*":
+			for i := 0; i+1 < len(path); i += 2 {
+				box.add(path[i], path[i+1])
+			}
+			path = path[:0]
+		case "n":
+			path = path[:0]
+		case "BT":
+			tm, tlm = identityMatrix, identityMatrix
+			tlo, thi = 0, 0
+		case "Tf":
+			if f := num(args, 1); f != nil {
+				gs.fontSize = f[0]
+			}
+		case "TL":
+			if f := num(args, 1); f != nil {
+				gs.leading = f[0]
+			}
+		case "Tz":
+			if f := num(args, 1); f != nil {
+				gs.hScale = f[0] / 100
+			}
+		case "Tc":
+			if f := num(args, 1); f != nil {
+				gs.charSpacing = f[0]
+			}
+		case "Tw":
+			if f := num(args, 1); f != nil {
+				gs.wordSpacing = f[0]
+			}
+		case "Ts":
+			if f := num(args, 1); f != nil {
+				gs.rise = f[0]
+			}
+		case "Td":
+			if f := num(args, 2); f != nil {
+				nextLine(f[0], f[1])
+			}
+		case "TD":
+			if f := num(args, 2); f != nil {
+				gs.leading = -f[1]
+				nextLine(f[0], f[1])
+			}
+		case "Tm":
+			if f := num(args, 6); f != nil {
+				tlm = matrix{f[0], f[1], f[2], f[3], f[4], f[5]}
+				tm = tlm
+				tlo, thi = 0, 0
+			}
+		case "T*":
+			nextLine(0, -gs.leading)
+		case "Tj", "TJ", "'":
+			if len(args) == 0 {
+				return errUnknownExtent
+			}
+			if op == "'" {
+				nextLine(0, -gs.leading)
+			}
+			return showText(args[len(args)-1])
+		case "\"":
+			if len(args) < 3 {
+				return errUnknownExtent
+			}
+			f := num(args[:len(args)-1], 2)
+			gs.wordSpacing, gs.charSpacing = f[0], f[1]
+			nextLine(0, -gs.leading)
+			return showText(args[len(args)-1])
+		case "EI":
+			box.addRect(rect{0, 0, 1, 1}, gs.ctm)
+		case "Do":
+			if len(args) == 0 {
+				return errUnknownExtent
+			}
+			r, err := xObjectBBox(d, dict, args[len(args)-1].str, gs.ctm, seen)
+			if err != nil {
+				return err
+			}
+			if r.isValid() {
+				box.addRect(r, identityMatrix)
+			}
+		case "sh", "d0", "d1":
+			return errUnknownExtent
+		}
+		return nil
+	})
+	if err != nil {
+		return rect{}, err
+	}
+	if box.empty {
+		// Nothing is painted
+		return rect{1, 1, 0, 0}, nil
+	}
+	return box.r, nil
+}
+
+// xObjectBBox returns the bounding box of what painting the named
+// XObject from the resources in the dictionary body dict paints,
+// transformed by ctm.
+func xObjectBBox(d, dict, name string, ctm matrix, seen map[int]bool) (rect, error) {
+	objDict := func(id int) string {
+		m := regexp.MustCompile(fmt.Sprintf(`(?ms)^%d 0 obj\n<<\n(.*?)^>>\n`, id)).FindStringSubmatch(d)
+		if m == nil {
+			return ""
+		}
+		return m[1]
+	}
+	// Resolve the resources and the XObject dictionary if indirect
+	res := dict
+	if m := regexp.MustCompile(`/Resources\s+(\d+)\s+\d+\s+R`).FindStringSubmatch(dict); m != nil {
+		id, _ := strconv.Atoi(m[1])
+		res = objDict(id)
+	}
+	if m := regexp.MustCompile(`/XObject\s+(\d+)\s+\d+\s+R`).FindStringSubmatch(res); m != nil {
+		id, _ := strconv.Atoi(m[1])
+		res = objDict(id)
+	} else if m := regexp.MustCompile(`(?s)/XObject\s*<<(.*?)>>`).FindStringSubmatch(res); m != nil {
+		res = m[1]
+	} else {
+		return rect{}, errUnknownExtent
+	}
+	m := regexp.MustCompile(fmt.Sprintf(`/%s\s+(\d+)\s+\d+\s+R`, regexp.QuoteMeta(name))).FindStringSubmatch(res)
+	if m == nil {
+		return rect{}, errUnknownExtent
+	}
+	id, _ := strconv.Atoi(m[1])
+	if seen[id] {
+		return rect{}, errUnknownExtent
+	}
+	xo := objDict(id)
+	if regexp.MustCompile(`/Subtype\s*/Image\b`).MatchString(xo) {
+		b := newBBox()
+		b.addRect(rect{0, 0, 1, 1}, ctm)
+		return b.r, nil
+	}
+	if !regexp.MustCompile(`/Subtype\s*/Form\b`).MatchString(xo) {
+		return rect{}, errUnknownExtent
+	}
+
+	fm := identityMatrix
+	if m := regexp.MustCompile(fmt.Sprintf(`/Matrix\s*\[\s*%s\s+%s\s+%s\s+%s\s+%s\s+%s\s*\]`,
+		pdfNumRe, pdfNumRe, pdfNumRe, pdfNumRe, pdfNumRe, pdfNumRe)).FindStringSubmatch(xo); m != nil {
+		for i := range fm {
+			f, _ := strconv.ParseFloat(m[i+1], 64)
+			fm[i] = f
+		}
+	}
+	ctm = fm.mul(ctm)
+
+	// The content of a form is clipped to its BBox, so use it unless
+	// the content can be bound more tightly
+	var formBox rect
+	bm := regexp.MustCompile(fmt.Sprintf(`/BBox\s*\[\s*%s\s+%s\s+%s\s+%s\s*\]`,
+		pdfNumRe, pdfNumRe, pdfNumRe, pdfNumRe)).FindStringSubmatch(xo)
+	if bm == nil {
+		return rect{}, errUnknownExtent
+	}
+	var f [4]float64
+	for i := range f {
+		v, _ := strconv.ParseFloat(bm[i+1], 64)
+		f[i] = v
+	}
+	b := newBBox()
+	b.addRect(rect{f[0], f[1], f[2], f[3]}, ctm)
+	formBox = b.r
+
+	sm := regexp.MustCompile(fmt.Sprintf(`(?ms)^%d 0 obj\n<<\n.*?^>>\nstream\n(.*?)\nendstream\nendobj`, id)).FindStringSubmatch(d)
+	if sm == nil {
+		return formBox, nil
+	}
+	data, err := decodeStream(xo, sm[1])
+	if err != nil {
+		return formBox, nil
+	}
+	res = xo
+	if !strings.Contains(xo, "/Resources") {
+		// Forms without resources of their own use those of the page
+		res = dict
+	}
+	seen[id] = true
+	r, err := streamBBox(d, data, res, ctm, seen)
+	delete(seen, id)
+	if err != nil {
+		return formBox, nil
+	}
+	return r.intersect(formBox), nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testTokens returns the tokens as a string, with numbers as they are,
+// names with their slash, strings as (characters spaces), arrays in
+// brackets and other tokens as _.
+func testTokens(args []contentToken) string {
+	var s []string
+	for _, a := range args {
+		switch a.kind {
+		case tokenNum:
+			s = append(s, fmt.Sprint(a.num))
+		case tokenName:
+			s = append(s, "/"+a.str)
+		case tokenString:
+			s = append(s, fmt.Sprintf("(%d %d)", a.chars, a.spaces))
+		case tokenArray:
+			s = append(s, "["+testTokens(a.elems)+"]")
+		default:
+			s = append(s, "_")
+		}
+	}
+	return strings.Join(s, " ")
+}
+
+func TestLexContent(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want []string
+	}{
+		{"operators", "q 1 0 0 1 10 -2.5 cm Q", []string{"q ", "cm 1 0 0 1 10 -2.5", "Q "}},
+		{"names", "/GS1 gs /F1 12 Tf", []string{"gs /GS1", "Tf /F1 12"}},
+		{"comments", "% q\nQ % Q\n", []string{"Q "}},
+		{"string", "(a b) Tj", []string{"Tj (3 1)"}},
+		{"escapes", `(a\)b\(c\\) Tj`, []string{"Tj (6 0)"}},
+		{"octal escapes", `(a\040b\0617) Tj`, []string{"Tj (5 1)"}},
+		{"nested parentheses", "(a(b)c) Tj", []string{"Tj (5 0)"}},
+		{"hex string", "<41 20 42 2> Tj", []string{"Tj (4 1)"}},
+		{"array", "[ (ab) -250 (c d) ] TJ", []string{"TJ [(2 0) -250 (3 1)]"}},
+		{"nested arrays and dictionaries", "[ (a) [ 1 2 ] << /A [ 3 ] /B (x) >> true ] TJ", []string{"TJ [(1 0) [1 2] _ _]"}},
+		{"marked content", "/Span << /ActualText (x) >> BDC EMC", []string{"BDC /Span _", "EMC "}},
+		{"inline image", "q BI /W 2 /H 1 /BPC 8 /CS /G ID \xff) EI\x00 Q", []string{"q ", "BI ", "ID /W 2 /H 1 /BPC 8 /CS /G", "EI ", "Q "}},
+	}
+	for _, tt := range tests {
+		var got []string
+		err := lexContent(tt.s, func(op string, args []contentToken) error {
+			got = append(got, op+" "+testTokens(args))
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: lexContent(%q) = %q, want %q", tt.name, tt.s, got, tt.want)
+		}
+	}
+
+	for _, s := range []string{"<41 Tj", "BI /W 1 ID xx"} {
+		if err := lexContent(s, func(string, []contentToken) error { return nil }); err == nil {
+			t.Errorf("lexContent(%q) succeeded", s)
+		}
+	}
+}
+
+func TestStreamBBox(t *testing.T) {
+	d := testQDF(
+		testDict("/Pages 2 0 R", "/Type /Catalog"),
+		testDict("/Count 0", "/Kids [ ]", "/Type /Pages"),
+		testDict("/Height 1", "/Length 1", "/Subtype /Image", "/Type /XObject", "/Width 1")+"\nstream\nx\nendstream",
+		testDict("/BBox [ 0 0 100 100 ]", "/Length 14", "/Matrix [ 1 0 0 1 50 50 ]", "/Subtype /Form", "/Type /XObject")+
+			"\nstream\n0 0 10 10 re f\nendstream",
+		testDict("/BBox [ 0 0 100 100 ]", "/Length 2", "/Subtype /Form", "/Type /XObject")+"\nstream\nsh\nendstream",
+	)
+	res := "  /Resources <<\n    /XObject <<\n      /Fm1 4 0 R\n      /Fm2 5 0 R\n      /Im1 3 0 R\n    >>\n  >>"
+	tests := []struct {
+		name string
+		s    string
+		want rect
+		err  error
+	}{
+		{"nothing", "q Q", rect{1, 1, 0, 0}, nil},
+		{"fill", "10 20 30 40 re f", rect{10, 20, 40, 60}, nil},
+		{"cm, q and Q", "q 2 0 0 2 10 10 cm 0 0 5 5 re f Q 0 0 1 1 re f", rect{0, 0, 20, 20}, nil},
+		{"stroke", "5 w 10 10 m 20 10 l S", rect{7.5, 7.5, 22.5, 12.5}, nil},
+		{"stroke scaled", "q 2 0 0 2 0 0 cm 5 w 10 10 m 20 10 l S Q", rect{15, 15, 45, 25}, nil},
+		{"line width restored", "q 10 w Q 10 10 m 20 10 l S", rect{9.5, 9.5, 20.5, 10.5}, nil},
+		{"clip path", "0 0 100 100 re W n 1 1 2 2 re f", rect{1, 1, 3, 3}, nil},
+		{"text", "BT /F1 10 Tf 100 200 Td (abc) Tj ET", rect{100, 197.5, 130, 210}, nil},
+		{"text lines", "BT /F1 10 Tf 12 TL 0 100 Td (ab) Tj T* (abc) ' ET", rect{0, 73.5, 30, 110}, nil},
+		{"text adjusted", "BT /F1 10 Tf 100 200 Td [ (a) 2000 (b) ] TJ ET", rect{80, 197.5, 110, 210}, nil},
+		{"text spread", "BT /F1 10 Tf 100 200 Td [ (a) -3000 (b) ] TJ ET", rect{100, 197.5, 150, 210}, nil},
+		{"character and word spacing", "BT /F1 10 Tf 2 Tc 30 Tw (a b) Tj ET", rect{0, -2.5, 64, 10}, nil},
+		{"negative spacing", "BT /F1 10 Tf -20 Tc (abc) Tj ET", rect{-40, -2.5, 10, 10}, nil},
+		{"spacing of \"", "BT /F1 10 Tf 12 TL 0 100 Td 30 2 (a b) \" ET", rect{0, 85.5, 64, 98}, nil},
+		{"rise", "BT /F1 10 Tf 5 Ts (a) Tj ET", rect{0, 2.5, 10, 15}, nil},
+		{"horizontal scaling", "BT /F1 10 Tf 50 Tz (abc) Tj ET", rect{0, -2.5, 15, 10}, nil},
+		{"text state restored", "BT /F1 10 Tf q 100 Tc Q (ab) Tj ET", rect{0, -2.5, 20, 10}, nil},
+		{"text after text", "BT /F1 10 Tf 2000 Tc (a) Tj (b) Tj ET", rect{0, -2.5, 2020, 10}, nil},
+		{"text array in array", "BT /F1 10 Tf [ [ (a) ] ] TJ ET", rect{}, errUnknownExtent},
+		{"inline image", "q 10 0 0 20 5 5 cm BI /W 1 /H 1 ID x EI Q", rect{5, 5, 15, 25}, nil},
+		{"image", "q 10 0 0 10 0 0 cm /Im1 Do Q", rect{0, 0, 10, 10}, nil},
+		{"form", "/Fm1 Do", rect{50, 50, 60, 60}, nil},
+		{"form with a shading", "/Fm2 Do", rect{0, 0, 100, 100}, nil},
+		{"missing XObject", "/Fm3 Do", rect{}, errUnknownExtent},
+		{"shading", "0 0 10 10 re f /Sh1 sh", rect{}, errUnknownExtent},
+	}
+	for _, tt := range tests {
+		got, err := streamBBox(d, tt.s, res, identityMatrix, map[int]bool{})
+		if err != tt.err || (err == nil && got != tt.want) {
+			t.Errorf("%s: streamBBox(%q) = %v, %v, want %v, %v", tt.name, tt.s, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestDropBlankTiles(t *testing.T) {
+	// The adjustment pushes the second glyph onto the next tile and the
+	// bottom row is blank. The content is compressed with Flate.
+	stream := "BT /F1 10 Tf 150 300 Td [ (a) -6000 (b) ] TJ ET"
+	b := &bytes.Buffer{}
+	w := zlib.NewWriter(b)
+	w.Write([]byte(stream))
+	w.Close()
+	d := testQDF(
+		testDict("/Pages 2 0 R", "/Type /Catalog"),
+		testDict("/Count 1", "/Kids [ 3 0 R ]", "/Type /Pages"),
+		testDict("/Contents 4 0 R", "/MediaBox [ 0 0 400 400 ]", "/Parent 2 0 R", "/Type /Page"),
+		testDict("/Filter /FlateDecode", fmt.Sprintf("/Length %d", b.Len()))+"\nstream\n"+b.String()+"\nendstream",
+	)
+	p := getAllPages(d)[0]
+	ts, err := cutPageToTiles(p, tileLayout{tileW: 200, tileH: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, tile := range dropBlankTiles(d, p, ts) {
+		kept = append(kept, tileLabel(tile))
+	}
+	if want := []string{"B1", "B2"}; !reflect.DeepEqual(kept, want) {
+		t.Errorf("kept tiles %q, want %q", kept, want)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// job is a row of -jobs-file.
+type job struct {
+	line    int
+	in, out string
+	args    []string
+}
+
+// jobFlagRe matches the flags given on the command line which are run
+// options of -jobs-file rather than of each job.
+var jobFlagRe = regexp.MustCompile(`^--?(jobs-file|jobs)(=.*)?$`)
+
+// readJobs returns the jobs of the CSV file name, each row of which has
+// the input, the output, the tile size (default if empty) and further
+// options, one argument per field so values with spaces or commas can be
+// quoted as in any CSV file. Empty fields of options are dropped. Empty
+// rows and rows starting with # are skipped.
+func readJobs(name string) ([]job, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	var jobs []job
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't read %s: %w", name, err)
+		}
+		line, _ := r.FieldPos(0)
+		if len(row) < 2 {
+			return nil, fmt.Errorf("%s:%d: rows must have an input, an output and optionally a tile size and options", name, line)
+		}
+		j := job{line: line, in: row[0], out: row[1]}
+		if j.in == "" || j.in == "-" || j.out == "" || j.out == "-" {
+			return nil, fmt.Errorf("%s:%d: input and output must be files", name, line)
+		}
+		j.args = []string{"-in", j.in, "-out", j.out}
+		if len(row) > 2 && row[2] != "" {
+			j.args = append(j.args, "-tile-size", row[2])
+		}
+		if len(row) > 3 {
+			for _, a := range row[3:] {
+				if a != "" {
+					j.args = append(j.args, a)
+				}
+			}
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+// runJobsFile runs each job of name as a pdftilecut process of its own,
+// up to -jobs at once, with the options given on the command line
+// followed by those of the job. The output of each job is printed once
+// it's done, and failed jobs are reported at the end.
+func runJobsFile(name string) error {
+	var clash error
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "in", "out", "tile-size":
+			clash = errors.New("-jobs-file can't be used with -in, -out or -tile-size")
+		}
+	})
+	if clash != nil {
+		return clash
+	}
+	if *numJobs < 1 {
+		return errors.New("-jobs must be at least 1")
+	}
+	jobs, err := readJobs(name)
+	if err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	// Jobs run in parallel rather than their tiles
+	var common []string
+	args := os.Args[1:]
+	for i := 0; i < len(args); i++ {
+		if m := jobFlagRe.FindStringSubmatch(args[i]); m != nil {
+			if m[2] == "" {
+				i++
+			}
+			continue
+		}
+		common = append(common, args[i])
+	}
+	common = append(common, "-jobs", "1")
+
+	errs := make([]error, len(jobs))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, *numJobs)
+	for i, j := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, j job) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			cmd := exec.Command(exe, append(append([]string{}, common...), j.args...)...)
+			out, err := cmd.CombinedOutput()
+			mu.Lock()
+			defer mu.Unlock()
+			if len(out) > 0 {
+				log.Printf("%s:%d: %s -> %s:\n%s", name, j.line, j.in, j.out, strings.TrimRight(string(out), "\n"))
+			}
+			errs[i] = err
+		}(i, j)
+	}
+	wg.Wait()
+
+	failed := 0
+	for i, j := range jobs {
+		if errs[i] != nil {
+			failed++
+			log.Printf("%s:%d: %s -> %s failed: %s", name, j.line, j.in, j.out, errs[i])
+		} else {
+			log.Printf("%s:%d: %s -> %s done", name, j.line, j.in, j.out)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d jobs failed", failed, len(jobs))
+	}
+	return nil
+}
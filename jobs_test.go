@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadJobs(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "jobs.csv")
+	csv := `# input, output, tile size, options...
+mars.pdf, mars_a4.pdf, A4, -poster
+
+venus.pdf, venus_a3.pdf, A3, -printer, laser, -overlap, 5mm
+earth.pdf, earth.pdf, , -title, "Earth, from orbit", -title-wrap=false,
+moon.pdf, moon.pdf
+`
+	if err := ioutil.WriteFile(name, []byte(csv), 0666); err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := readJobs(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []job{
+		{2, "mars.pdf", "mars_a4.pdf", []string{"-in", "mars.pdf", "-out", "mars_a4.pdf", "-tile-size", "A4", "-poster"}},
+		{4, "venus.pdf", "venus_a3.pdf", []string{"-in", "venus.pdf", "-out", "venus_a3.pdf", "-tile-size", "A3", "-printer", "laser", "-overlap", "5mm"}},
+		{5, "earth.pdf", "earth.pdf", []string{"-in", "earth.pdf", "-out", "earth.pdf", "-title", "Earth, from orbit", "-title-wrap=false"}},
+		{6, "moon.pdf", "moon.pdf", []string{"-in", "moon.pdf", "-out", "moon.pdf"}},
+	}
+	if !reflect.DeepEqual(jobs, want) {
+		t.Errorf("readJobs() = %q, want %q", jobs, want)
+	}
+
+	for _, tt := range []struct{ csv, err string }{
+		{"mars.pdf\n", "jobs.csv:1: rows must have"},
+		{"mars.pdf, -\n", "jobs.csv:1: input and output must be files"},
+		{"a.pdf, b.pdf\n, mars.pdf\n", "jobs.csv:2: input and output must be files"},
+		{"mars.pdf, \"mars\n", "can't read"},
+	} {
+		if err := ioutil.WriteFile(name, []byte(tt.csv), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readJobs(name); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("readJobs(%q) fails with %v, want %q", tt.csv, err, tt.err)
+		}
+	}
+}
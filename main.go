@@ -1,6 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -11,9 +17,14 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"runtime/debug"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf16"
 
 	"github.com/oxplot/papersizes"
 
@@ -28,17 +39,69 @@ const (
 	bleedMargin       = ptsInInch * 5 / 6 // in pt from media box
 	trimMargin        = ptsInInch / 6     // in pt from bleed box
 	trimMarkLineWidth = 0.5               // in pt
+	markHaloWidth     = 0.75              // in pt on each side of marks with -mark-halo
+	printMarkRoom     = 24                // in pt from printable area to bleed box
+
+	// name of the input when read from stdin into memory
+	stdinName = "stdin"
+
+	// resource name of the pattern filling the margin with -bleed-hatch
+	hatchPatternName = "PdftilecutHatch"
+	hatchSpacing     = 6 // in pt
+
+	// resource name of the optional content group of the overlays with
+	// -marks-as-layer
+	marksLayerName = "PdftilecutMarks"
+
+	// resource names of the graphics states setting overprinting with
+	// -bleed-overprint
+	overprintGSName = "PdftilecutOverprint"
+	knockoutGSName  = "PdftilecutKnockout"
 
 	// Min page size in mm
 	minPageDimension = (bleedMargin + trimMargin + trimMarkLineWidth) * 2 * mmInInch / ptsInInch
 )
 
+// unit to mm ratios
+var unitsToMillimeter = map[string]float64{
+	"mm": 1,
+	"cm": mmInCm,
+	"in": mmInInch,
+	"pt": mmInInch / ptsInInch,
+}
+
+// nupFlag is a grid of pages to put on each sheet, as columns x rows.
+type nupFlag struct {
+	cols, rows int
+}
+
+func (v *nupFlag) String() string {
+	if v.cols == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%dx%d", v.cols, v.rows)
+}
+
+func (v *nupFlag) Set(s string) error {
+	m := regexp.MustCompile(`^\s*(\d+)\s*x\s*(\d+)\s*$`).FindStringSubmatch(s)
+	if m == nil {
+		return errors.New("must be columns x rows (e.g. 2x2)")
+	}
+	cols, _ := strconv.Atoi(m[1])
+	rows, _ := strconv.Atoi(m[2])
+	if cols < 1 || rows < 1 {
+		return errors.New("columns and rows must be at least 1")
+	}
+	v.cols, v.rows = cols, rows
+	return nil
+}
+
 type tileSizeFlag struct {
 	name string
 
 	// in millimeters
-	width  float32
-	height float32
+	width  float64
+	height float64
 
 	isDim bool
 }
@@ -51,19 +114,12 @@ func (v *tileSizeFlag) String() string {
 }
 
 func (v *tileSizeFlag) Set(s string) error {
-	// unit to mm ratios
-	unitsToMillimeter := map[string]float32{
-		"mm": 1,
-		"cm": mmInCm,
-		"in": mmInInch,
-		"pt": mmInInch / ptsInInch,
-	}
 	// known paper sizes
 	size := papersizes.FromName(s)
 	if size != nil {
 		v.name = size.Name
-		v.width = float32(size.Width)
-		v.height = float32(size.Height)
+		v.width = float64(size.Width)
+		v.height = float64(size.Height)
 		v.isDim = false
 	} else {
 		// w x h dimensions
@@ -73,10 +129,10 @@ func (v *tileSizeFlag) Set(s string) error {
 			return errors.New("invalid tile size")
 		}
 		v.name = parts[1] + parts[2] + "x" + parts[3] + parts[4]
-		w, _ := strconv.ParseFloat(parts[1], 32)
-		v.width = float32(w) * unitsToMillimeter[parts[2]]
-		h, _ := strconv.ParseFloat(parts[3], 32)
-		v.height = float32(h) * unitsToMillimeter[parts[4]]
+		w, _ := strconv.ParseFloat(parts[1], 64)
+		v.width = w * unitsToMillimeter[parts[2]]
+		h, _ := strconv.ParseFloat(parts[3], 64)
+		v.height = h * unitsToMillimeter[parts[4]]
 		v.isDim = true
 	}
 	if v.width < minPageDimension || v.height < minPageDimension {
@@ -85,40 +141,569 @@ func (v *tileSizeFlag) Set(s string) error {
 	return nil
 }
 
+// tileSizesFlag holds one or more tile sizes, each producing an output.
+type tileSizesFlag struct {
+	sizes []tileSizeFlag
+
+	// whether sizes were given on the command line, replacing the default
+	isSet bool
+}
+
+func (v *tileSizesFlag) String() string {
+	var s []string
+	for i := range v.sizes {
+		s = append(s, v.sizes[i].String())
+	}
+	return strings.Join(s, ", ")
+}
+
+func (v *tileSizesFlag) Set(s string) error {
+	var size tileSizeFlag
+	if err := size.Set(s); err != nil {
+		return err
+	}
+	if !v.isSet {
+		v.sizes = nil
+		v.isSet = true
+	}
+	v.sizes = append(v.sizes, size)
+	return nil
+}
+
+// pageTileSizesFlag maps page numbers of the input to their own tile
+// size, given as comma separated page:size pairs.
+type pageTileSizesFlag struct {
+	sizes map[int]tileSizeFlag
+}
+
+func (v *pageTileSizesFlag) String() string {
+	var pages []int
+	for n := range v.sizes {
+		pages = append(pages, n)
+	}
+	sort.Ints(pages)
+	var s []string
+	for _, n := range pages {
+		size := v.sizes[n]
+		s = append(s, fmt.Sprintf("%d:%s", n, size.String()))
+	}
+	return strings.Join(s, ", ")
+}
+
+func (v *pageTileSizesFlag) Set(s string) error {
+	sizes := map[int]tileSizeFlag{}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return errors.New("must be comma separated page:size pairs (e.g. 1:A3,2:A4)")
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid page number %q", parts[0])
+		}
+		var size tileSizeFlag
+		if err := size.Set(strings.TrimSpace(parts[1])); err != nil {
+			return fmt.Errorf("page %d: %w", n, err)
+		}
+		sizes[n] = size
+	}
+	v.sizes = sizes
+	return nil
+}
+
+// lengthFlag is a length given with a unit, stored in millimeters.
+type lengthFlag float64
+
+func (v *lengthFlag) String() string {
+	return fmt.Sprintf("%gmm", float64(*v))
+}
+
+func (v *lengthFlag) Set(s string) error {
+	lenRe := regexp.MustCompile(`^\s*(\d+(?:\.\d+)?)\s*(mm|cm|in|pt)\s*$`)
+	parts := lenRe.FindStringSubmatch(s)
+	if parts == nil {
+		return errors.New("invalid length")
+	}
+	l, _ := strconv.ParseFloat(parts[1], 64)
+	*v = lengthFlag(l * unitsToMillimeter[parts[2]])
+	return nil
+}
+
+// pt returns the length in points.
+func (v lengthFlag) pt() float64 {
+	return float64(v) * ptsInInch / mmInInch
+}
+
+// ratioFlag is the scale of a drawing as the number of units in reality
+// per unit on the page, given as 1:N, zero if not set.
+type ratioFlag float64
+
+func (v *ratioFlag) String() string {
+	if *v == 0 {
+		return ""
+	}
+	return fmt.Sprintf("1:%g", float64(*v))
+}
+
+func (v *ratioFlag) Set(s string) error {
+	ratioRe := regexp.MustCompile(`^\s*1\s*:\s*(\d+(?:\.\d+)?)\s*$`)
+	parts := ratioRe.FindStringSubmatch(s)
+	if parts == nil {
+		return errors.New("must be a ratio of 1:N (e.g. 1:100)")
+	}
+	r, _ := strconv.ParseFloat(parts[1], 64)
+	if r == 0 {
+		return errors.New("ratio must not be 1:0")
+	}
+	*v = ratioFlag(r)
+	return nil
+}
+
+// insetFlag holds per side insets in percentage of page dimensions.
+type insetFlag struct {
+	top, right, bottom, left float64
+}
+
+func (v *insetFlag) String() string {
+	return fmt.Sprintf("%g%%,%g%%,%g%%,%g%%", v.top, v.right, v.bottom, v.left)
+}
+
+func (v *insetFlag) Set(s string) error {
+	pctRe := regexp.MustCompile(`^\s*(\d+(?:\.\d+)?)\s*%\s*$`)
+	var vals []float64
+	for _, p := range strings.Split(s, ",") {
+		parts := pctRe.FindStringSubmatch(p)
+		if parts == nil {
+			return errors.New("invalid inset")
+		}
+		f, _ := strconv.ParseFloat(parts[1], 64)
+		vals = append(vals, f)
+	}
+	switch len(vals) {
+	case 1:
+		v.top, v.right, v.bottom, v.left = vals[0], vals[0], vals[0], vals[0]
+	case 2:
+		v.top, v.right, v.bottom, v.left = vals[0], vals[1], vals[0], vals[1]
+	case 4:
+		v.top, v.right, v.bottom, v.left = vals[0], vals[1], vals[2], vals[3]
+	default:
+		return errors.New("inset must have 1, 2 or 4 values")
+	}
+	if v.top+v.bottom >= 100 || v.left+v.right >= 100 {
+		return errors.New("insets must leave some of the page")
+	}
+	return nil
+}
+
+func (v *insetFlag) isSet() bool {
+	return v.top != 0 || v.right != 0 || v.bottom != 0 || v.left != 0
+}
+
+// edgeNames are the tile edges by their names in flags.
+var edgeNames = []struct {
+	name string
+	edge int
+}{
+	{"top", edgeTop}, {"right", edgeRight}, {"bottom", edgeBottom}, {"left", edgeLeft},
+}
+
+// edgesFlag holds a set of tile edges.
+type edgesFlag int
+
+func (v *edgesFlag) String() string {
+	var names []string
+	for _, e := range edgeNames {
+		if int(*v)&e.edge != 0 {
+			names = append(names, e.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func (v *edgesFlag) Set(s string) error {
+	var edges int
+	for _, n := range strings.Split(s, ",") {
+		n = strings.TrimSpace(n)
+		found := false
+		for _, e := range edgeNames {
+			if n == e.name {
+				edges |= e.edge
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown edge %q", n)
+		}
+	}
+	*v = edgesFlag(edges)
+	return nil
+}
+
+// apply returns r shrunk by the insets.
+func (v *insetFlag) apply(r rect) rect {
+	w, h := r.urx-r.llx, r.ury-r.lly
+	return rect{
+		r.llx + w*v.left/100,
+		r.lly + h*v.bottom/100,
+		r.urx - w*v.right/100,
+		r.ury - h*v.top/100,
+	}
+}
+
+// margins holds per side distances in pt.
+type margins struct {
+	top, right, bottom, left float64
+}
+
+// printerFlag holds the unprintable margins of a printer in mm.
+type printerFlag struct {
+	name                     string
+	top, right, bottom, left float64
+}
+
+// printerProfiles are the unprintable margins of common printer types.
+var printerProfiles = map[string]printerFlag{
+	"laser":      {"laser", 4.2, 4.2, 4.2, 4.2},
+	"inkjet":     {"inkjet", 3, 3.4, 5, 3.4},
+	"photo":      {"photo", 3, 3, 3, 3},
+	"borderless": {"borderless", 0, 0, 0, 0},
+}
+
+func (v *printerFlag) String() string {
+	if v.name == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s (%gmm,%gmm,%gmm,%gmm)", v.name, v.top, v.right, v.bottom, v.left)
+}
+
+func (v *printerFlag) Set(s string) error {
+	if p, ok := printerProfiles[s]; ok {
+		*v = p
+		return nil
+	}
+	if !strings.HasPrefix(s, "custom:") {
+		return errors.New("unknown printer profile")
+	}
+	mmRe := regexp.MustCompile(`^\s*(\d+(?:\.\d+)?)\s*$`)
+	var vals []float64
+	for _, p := range strings.Split(strings.TrimPrefix(s, "custom:"), ",") {
+		parts := mmRe.FindStringSubmatch(p)
+		if parts == nil {
+			return errors.New("invalid printer margin")
+		}
+		f, _ := strconv.ParseFloat(parts[1], 64)
+		vals = append(vals, f)
+	}
+	if len(vals) != 4 {
+		return errors.New("custom printer must have top, right, bottom and left margins")
+	}
+	*v = printerFlag{"custom", vals[0], vals[1], vals[2], vals[3]}
+	return nil
+}
+
+// bleedMargins returns the margins between the media box and the bleed
+// box of the tiles. Without a printer profile, they are large enough for
+// most printers.
+func (v *printerFlag) bleedMargins() margins {
+	if v.name == "" {
+		return margins{bleedMargin, bleedMargin, bleedMargin, bleedMargin}
+	}
+	toPt := func(mm float64) float64 {
+		return mm*ptsInInch/mmInInch + printMarkRoom
+	}
+	return margins{toPt(v.top), toPt(v.right), toPt(v.bottom), toPt(v.left)}
+}
+
 var (
-	inputFile     = flag.String("in", "-", "input PDF")
-	outputFile    = flag.String("out", "-", "output PDF")
-	tileTitle     = flag.String("title", "", "title to show on margin of each tile (defaults to input filename)")
-	debugMode     = flag.Bool("debug", false, "run in debug mode")
-	longTrimMarks = flag.Bool("long-trim-marks", false, "Use full width/height trim marks")
-	tileSize      tileSizeFlag
+	inputFile         = flag.String("in", "-", "input PDF")
+	outputFile        = flag.String("out", "-", "output PDF")
+	tileTitle         = flag.String("title", "", "title to show on margin of each tile (defaults to input filename)")
+	debugMode         = flag.Bool("debug", false, "run in debug mode")
+	longTrimMarks     = flag.Bool("long-trim-marks", false, "Use full width/height trim marks")
+	outerMarksOnly    = flag.Bool("outer-marks-only", false, "only draw trim marks on the outer edges of the original page")
+	assemblyMap       = flag.Bool("assembly-map", false, "add a page before the tiles of each page showing how they are arranged")
+	extendBleed       = flag.Bool("extend-bleed", false, "mirror the content along the outer edges of the original page into the bleed")
+	numJobs           = flag.Int("jobs", runtime.GOMAXPROCS(0), "number of tiles to process in parallel")
+	timeout           = flag.Duration("timeout", 0, "abort if processing takes longer than this (e.g. 1m30s), checked between stages")
+	pdfaMode          = flag.Bool("pdfa", false, "avoid breaking PDF/A conformance of the input where possible")
+	keepTags          = flag.Bool("keep-tags", false, "keep the structure tree of tagged PDFs, referring to the first tile of each page")
+	clipCorner        = flag.String("clip-corner", "", "corner of the paper the printer can't print on (tl, tr, bl or br) - marks are moved away from it")
+	pageLabels        = flag.Bool("page-labels", false, "label output pages in viewers with their tile reference")
+	pageLabelPrefix   = flag.String("page-label-prefix", "", "prefix of page labels (e.g. \"Tile \") - implies -page-labels")
+	contactSheet      = flag.Bool("contact-sheet", false, "append a page showing all tiles of each page scaled down")
+	cutGuides         = flag.Bool("cut-guides", false, "number the interior trim line intersections in the margin")
+	startNumber       = flag.Int("start-number", 1, "number shown on the tiles of the first page, subsequent pages are numbered consecutively")
+	grayscaleMarks    = flag.Bool("grayscale-marks", false, "draw marks and labels with gray instead of RGB colors")
+	outputRotate      = flag.Int("output-rotate", 0, "clockwise rotation in degrees (multiple of 90) set on the tiles for printers that feed by page orientation")
+	tileOrientation   = flag.String("tile-orientation", "auto", "orientation of the tiles (auto, portrait or landscape) - auto uses the tile size as given")
+	showProgress      = flag.Bool("progress", false, "report the number of tiles processed on stderr")
+	stdinMemoryLimit  = flag.Int("stdin-memory-limit", 64, "size in MiB of input from stdin to keep in memory, larger input is buffered in a temp file")
+	showVersion       = flag.Bool("version", false, "print version information and exit")
+	planMode          = flag.Bool("plan", false, "print the tiles each page would be cut into as JSON instead of writing the output")
+	upArrow           = flag.Bool("up-arrow", false, "draw an arrow and TOP in the top margin of tiles to show which way is up")
+	tabs              = flag.Bool("tabs", false, "add a glue tab to the top and right interior edges of tiles")
+	skipFitting       = flag.Bool("skip-fitting", false, "leave pages which already fit on the paper as they are, without marks")
+	titleWrap         = flag.Bool("title-wrap", false, "wrap titles too long for the tile onto a second line instead of cutting them short")
+	cover             = flag.Bool("cover", false, "add a page before the tiles explaining how to print and put them together")
+	dumpJSONMode      = flag.Bool("dump-json", false, "debug: print the objects and pages of the input as JSON instead of writing the output")
+	labelSourcePage   = flag.Bool("label-source-page", false, "refer to pages by the page labels of the input (e.g. iii) instead of their numbers where set")
+	skipBlank         = flag.Bool("skip-blank", false, "leave out tiles which no content of the page reaches")
+	bleedHatch        = flag.Bool("bleed-hatch", false, "hatch the margin outside the bleed box so it stands out when cutting")
+	cutList           = flag.String("cut-list", "", "write the cut positions of each output sheet in mm as JSON to this file, for automated cutters")
+	outputIntent      = flag.String("output-intent", "", "ICC profile file to embed as the output intent of the output for color managed printing")
+	dumpQDF           = flag.String("dump-qdf", "", "also write the input in the normalized QDF form pdftilecut works on to this file, e.g. for bug reports")
+	titleFromMeta     = flag.Bool("title-from-meta", false, "default the title to the title in the document information of the input, if any, instead of its filename")
+	marksAsLayer      = flag.Bool("marks-as-layer", false, "put the marks in a \"Trim Marks\" layer which can be hidden in viewers")
+	marksUnderBleed   = flag.Bool("marks-under-bleed", false, "draw the margin fill and hatching over the marks instead of under them")
+	outHash           = flag.Bool("out-hash", false, "name the output by a hash of the input and options, in the directory and with the extension of -out, and skip tiling if it already exists")
+	regMarks          = flag.String("registration-marks", "", "draw registration targets off the corners of all tiles (all) or only of the original page (outer)")
+	minContentMM      = flag.Float64("min-content-mm", 0, "warn when the content shown on a tile is narrower or shorter than this many mm")
+	sequentialNumbers = flag.Bool("sequential-numbers", false, "number the tiles 1, 2, 3, ... across all pages instead of showing the number of their page")
+	tileOrigin        = flag.String("origin", "bottom-left", "corner of the page of tile A1 (bottom-left, top-left, top-right or bottom-right) - tiles are referenced and ordered from there")
+	preset            = flag.String("preset", "", "set defaults suited to home-poster, print-shop or signage - options given explicitly take precedence")
+	warnLossy         = flag.Bool("warn-lossy", true, "warn about features of the input, such as annotations and bookmarks, which tiling can't fully preserve")
+	outDir            = flag.String("out-dir", "", "write each output page to a PDF of its own in this directory, with an index.txt listing them in print order, instead of -out")
+	bleedOverprint    = flag.String("bleed-overprint", "knockout", "overprinting of the margin fill and marks on press: knockout (none), marks (marks overprint the knocked out fill) or all")
+	selfTest          = flag.Bool("selftest", false, "tile a generated document and check the output to confirm the build works")
+	brick             = flag.String("brick", "", "rotate the content of alternate tiles 180° for patterns hung alternately: rows or checkerboard")
+	onlyTiles         = flag.String("tiles", "", "only output the tiles with the given comma separated references, e.g. A1,B3")
+	deterministic     = flag.Bool("deterministic", false, "derive the document ID from the content so the same input and options always give identical output")
+	markCap           = flag.String("mark-cap", "", "line cap of all the marks: butt, round or square")
+	verbose           = flag.Bool("verbose", false, "print a summary of each output written")
+	showSummary       = flag.Bool("summary", false, "print the size of each page, its grid of tiles and the size of the assembled poster")
+	fillTile          = flag.Bool("fill-tile", false, "scale each page so its tiles fill the paper within the margins, rather than shrinking the tiles to share the page evenly")
+	noGridGlyph       = flag.Bool("no-grid-glyph", false, "leave out the arrows next to the row and column of tiles")
+	noPageRef         = flag.Bool("no-page-ref", false, "leave out the PAGE number in the margin of tiles, keeping the tile reference")
+	parity            = flag.String("parity", "", "only tile the odd or even pages of the input, e.g. for printing both sides in two passes")
+	resetView         = flag.Bool("reset-view", false, "open the output one page at a time at the first page fitted to the window, instead of as the input opens")
+	streamFilter      = flag.String("stream-filter", "preserve", "filters of the streams of the output: preserve (compress new streams only), flate (compress all but images with Flate) or none (uncompressed but images) - for RIPs which mishandle some filters")
+	previewFile       = flag.String("preview", "", "also write a PNG to this file with a thumbnail of each tile laid out as on the poster, labelled with its reference")
+	previewCell       = flag.Int("preview-cell", 64, "size in pixels of the longer side of each thumbnail of -preview")
+	explain           = flag.Bool("explain", false, "print how the paper of the tiles is taken up by margins, bleed and content in mm instead of writing the output")
+	padGrid           = flag.Bool("pad-grid", false, "pad the grid of tiles of each page with blank tiles to the largest grid of all pages, for uniform stacks")
+	markHalo          = flag.Bool("mark-halo", false, "stroke a thin white halo under trim and registration marks so they show on dark content, e.g. with -bleed-overprint all")
+	jobsFile          = flag.String("jobs-file", "", "CSV file of jobs to run, each row with an input, an output, a tile size and further options a field each, up to -jobs of them at once")
+	centerContent     = flag.Bool("center-content", false, "center pages within the grid padded by -pad-grid, leaving the same margin of blank tiles on each side")
+	normalizeContent  = flag.Bool("normalize-content", false, "debug: write content streams with one operator per line, e.g. with -stream-filter none to read the marks")
+	verifyTiles       = flag.Bool("verify", false, "check the tiles of each page put back together cover it without gaps before writing the output")
+	maxAspect         = flag.Float64("max-aspect", 0, "cut pages into more tiles where that keeps the tiles from being more than this many times longer than wide (e.g. 2), 0 for no limit")
+	credit            = flag.String("credit", "", "credit line, e.g. a copyright notice, to show in the bottom margin of each tile")
+	creditPosition    = flag.String("credit-position", "bottom-right", "where in the bottom margin to show -credit: bottom-left or bottom-right")
+	idBase            = flag.Int("id-base", 0, "number the objects added by tiling from this id, leaving the ids between those of the input and it unused - the output is then written uncompressed with its ids as they are rather than by qpdf")
+	posterMode        = flag.Bool("poster", false, "poster mode - shorthand for -overlap 10mm -outer-marks-only -assembly-map")
+	tileSizes         tileSizesFlag
+	fitPaper          tileSizeFlag
+	tileOverlap       lengthFlag
+	minOverlap        lengthFlag
+	trimInset         insetFlag
+	clipSize          = lengthFlag(5)
+	tabWidth          = lengthFlag(10)
+	markGap           lengthFlag
+	kerf              lengthFlag
+	scaleBar          ratioFlag
+	markEdges         = edgesFlag(allEdges)
+
+	// directory holding all temp files
+	tempDir string
+
+	// files written by writeOutput, removed if processing times out
+	outputsWritten   []string
+	outputsWrittenMu sync.Mutex
+
+	// stdin input if it fits within -stdin-memory-limit
+	stdinData []byte
+
+	// take the title from the document information of the input once
+	// it's read
+	titleFromInfo bool
+
+	// ICC profile read from -output-intent
+	outputIntentProfile []byte
+
+	printer printerFlag
+	nup     nupFlag
+
+	pageTileSizes pageTileSizesFlag
 )
 
+// posterDefaults are the flag values implied by -poster.
+var posterDefaults = map[string]string{
+	"overlap":          "10mm",
+	"outer-marks-only": "true",
+	"assembly-map":     "true",
+}
+
+// presets are the flag values implied by each -preset.
+var presets = map[string]map[string]string{
+	// glued together at home from inkjet prints
+	"home-poster": {
+		"printer":          "inkjet",
+		"overlap":          "10mm",
+		"outer-marks-only": "true",
+		"assembly-map":     "true",
+		"up-arrow":         "true",
+	},
+	// trimmed by a print shop, so there's content to cut into
+	"print-shop": {
+		"printer":            "laser",
+		"extend-bleed":       "true",
+		"registration-marks": "all",
+		"page-labels":        "true",
+	},
+	// large panels butted together on site
+	"signage": {
+		"overlap":            "20mm",
+		"long-trim-marks":    "true",
+		"cut-guides":         "true",
+		"up-arrow":           "true",
+		"sequential-numbers": "true",
+	},
+}
+
+// envFlags are the flags which take their default from PDFTILECUT_*
+// environment variables, e.g. PDFTILECUT_TILE_SIZE for -tile-size.
+var envFlags = []string{
+	"tile-size",
+	"tile-orientation",
+	"printer",
+	"overlap",
+	"poster",
+	"grayscale-marks",
+	"page-labels",
+	"jobs",
+	"timeout",
+}
+
+// envName returns the name of the environment variable of the flag.
+func envName(flagName string) string {
+	return "PDFTILECUT_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// setEnvFlags sets envFlags from the environment unless they're already
+// set.
+func setEnvFlags() error {
+	for _, name := range envFlags {
+		value, ok := os.LookupEnv(envName(name))
+		if !ok {
+			continue
+		}
+		if err := setDefaultFlags(map[string]string{name: value}); err != nil {
+			return fmt.Errorf("invalid %s: %w", envName(name), err)
+		}
+	}
+	return nil
+}
+
 func init() {
-	_ = tileSize.Set("A4")
-	flag.Var(&tileSize, "tile-size",
-		"maximum size including margin - can be a standard paper size (eg A5), or width x height dimension with a unit (mm, cm, in, pt) (e.g. 6cm x 12in)")
+	var a4 tileSizeFlag
+	_ = a4.Set("A4")
+	tileSizes.sizes = []tileSizeFlag{a4}
+	flag.Var(&fitPaper, "fit-paper", "scale each page to fit on a single sheet of this size (e.g. A3) instead of cutting it into tiles")
+	flag.Var(&tileSizes, "tile-size",
+		"maximum size including margin - can be a standard paper size (eg A5), or width x height dimension with a unit (mm, cm, in, pt) (e.g. 6cm x 12in) - repeat for one output per size, named by size")
+	flag.Var(&pageTileSizes, "tile-sizes",
+		"tile sizes of individual pages as comma separated page:size pairs (e.g. 1:A3,2:A4), overriding -tile-size for those pages")
+	flag.Var(&tileOverlap, "overlap",
+		"minimum length of content repeated on adjacent tiles, with a unit (mm, cm, in, pt) (e.g. 1cm)")
+	flag.Var(&minOverlap, "min-overlap",
+		"raise the overlap of pages cut into several tiles to at least this length, with a unit (mm, cm, in, pt), failing if the tiles are too small")
+	flag.Var(&clipSize, "clip-size",
+		"size of the corner set by -clip-corner, with a unit (mm, cm, in, pt)")
+	flag.Var(&printer, "printer",
+		"printer profile (laser, inkjet, photo or borderless) or custom:top,right,bottom,left unprintable margins in mm, sizing the margins so marks are printable")
+	flag.Var(&tabWidth, "tab-width",
+		"width of the glue tabs beyond the bleed set by -tabs, with a unit (mm, cm, in, pt)")
+	flag.Var(&nup, "nup",
+		"put the output pages onto larger sheets in a grid of columns x rows of the paper (e.g. 2x2), with cut lines between them")
+	flag.Var(&kerf, "kerf",
+		"width of the cut between tiles, with a unit (mm, cm, in, pt) - tiles show half of it more of the page on interior edges so cut tiles butted together leave no gap")
+	flag.Var(&markGap, "mark-gap",
+		"extra gap between the bleed box and the start of trim marks, with a unit (mm, cm, in, pt) - with -long-trim-marks, the gap is left around the trim corners")
+	flag.Var(&scaleBar, "scale-bar",
+		"scale of the drawing (e.g. 1:100) to draw a scale bar for in the bottom margin of each tile")
+	flag.Var(&markEdges, "marks",
+		"comma separated edges of the tiles to draw trim marks on (top, right, bottom, left) - with -outer-marks-only, only those of them on the outer edges")
+	flag.Var(&trimInset, "trim-inset",
+		"cut the region inset from the media box by a percentage of page size, overriding the trim box - one value for all sides, vertical,horizontal or top,right,bottom,left (e.g. 5% or 5%,2%)")
+}
+
+// setDefaultFlags sets the given flags to the given values unless they
+// were set on the command line or by an earlier call.
+func setDefaultFlags(defaults map[string]string) error {
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for name, value := range defaults {
+		if explicit[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // getNextFreeObjectID returns the largest object id in the document + 1
 func getNextFreeObjectID(d string) (int, error) {
-	m := regexp.MustCompile(`(?m)^xref\s+\d+\s+(\d+)`).FindStringSubmatch(d)
-	if m == nil {
+	// The last xref section covers all objects
+	ms := regexp.MustCompile(`(?m)^xref\s+\d+\s+(\d+)`).FindAllStringSubmatch(d, -1)
+	if ms == nil {
 		return 0, fmt.Errorf("cannot find the next free object id")
 	}
-	return strconv.Atoi(m[1])
+	return strconv.Atoi(ms[len(ms)-1][1])
 }
 
 type rect struct {
 	// ll = lower left
 	// ur = upper right
-	llx, lly, urx, ury float32
+	llx, lly, urx, ury float64
 }
 
 func (r rect) isValid() bool {
 	return r.llx <= r.urx && r.lly <= r.ury
 }
 
+// intersect returns the area covered by both r and o.
+func (r rect) intersect(o rect) rect {
+	if o.llx > r.llx {
+		r.llx = o.llx
+	}
+	if o.lly > r.lly {
+		r.lly = o.lly
+	}
+	if o.urx < r.urx {
+		r.urx = o.urx
+	}
+	if o.ury < r.ury {
+		r.ury = o.ury
+	}
+	return r
+}
+
+// pdfArray returns the rect as the numbers of a PDF rectangle.
+func (r rect) pdfArray() string {
+	return strings.Join([]string{pdfNum(r.llx), pdfNum(r.lly), pdfNum(r.urx), pdfNum(r.ury)}, " ")
+}
+
+// union returns the smallest rect covering both r and o.
+func (r rect) union(o rect) rect {
+	if o.llx < r.llx {
+		r.llx = o.llx
+	}
+	if o.lly < r.lly {
+		r.lly = o.lly
+	}
+	if o.urx > r.urx {
+		r.urx = o.urx
+	}
+	if o.ury > r.ury {
+		r.ury = o.ury
+	}
+	return r
+}
+
 type page struct {
 	id     int
 	number int
@@ -126,47 +711,155 @@ type page struct {
 	tileX int
 	tileY int
 
+	// number of tiles the original page is cut into horizontally and
+	// vertically
+	hTiles int
+	vTiles int
+
 	mediaBox   rect
 	cropBox    rect
 	bleedBox   rect
 	trimBox    rect
 	contentIds []int
 
+	// clockwise rotation in degrees applied when displaying or printing
+	rotate int
+
+	// name of the page if not a tile (e.g. assembly map)
+	name string
+
+	// whether the tile is the original page left as is
+	asIs bool
+
+	// label of the original page shown instead of its number, if any
+	label string
+
+	// scale and offset of the content of the original page on the tile
+	// and the cm operator placing it there, if not in place
+	scale      float64
+	offX, offY float64
+	contentCM  string
+
+	// position of the tile among the tiles of all pages, from 1
+	seq int
+
+	// id of the original page object the tile takes the place of, if
+	// it's the only tile of its page
+	origID int
+
+	// whether the content is turned 180° within the trim box (-brick)
+	flipped bool
+
 	parentID int
 	raw      string
 }
 
+// The following are tolerant of the layout of the page dictionary so
+// inputs formatted differently from qpdf's QDF output still parse.
 var (
-	boxReTpl    = `(?m)^\s+/%s\s*\[\s*(-?[\d.]+)\s+(-?[\d.]+)\s+(-?[\d.]+)\s+(-?[\d.]+)\s*\]`
-	bleedBoxRe  = regexp.MustCompile(fmt.Sprintf(boxReTpl, "BleedBox"))
-	cropBoxRe   = regexp.MustCompile(fmt.Sprintf(boxReTpl, "CropBox"))
-	mediaBoxRe  = regexp.MustCompile(fmt.Sprintf(boxReTpl, "MediaBox"))
-	trimBoxRe   = regexp.MustCompile(fmt.Sprintf(boxReTpl, "TrimBox"))
-	contentsRe  = regexp.MustCompile(`(?m)^\s+/Contents\s+(?:(\d+)|\[([^\]]*))`)
+	pdfNumRe   = `([+-]?(?:\d+\.?\d*|\.\d+))`
+	boxReTpl   = `/%s\s*\[\s*` + pdfNumRe + `\s+` + pdfNumRe + `\s+` + pdfNumRe + `\s+` + pdfNumRe + `\s*\]`
+	bleedBoxRe = regexp.MustCompile(fmt.Sprintf(boxReTpl, "BleedBox"))
+	cropBoxRe  = regexp.MustCompile(fmt.Sprintf(boxReTpl, "CropBox"))
+	mediaBoxRe = regexp.MustCompile(fmt.Sprintf(boxReTpl, "MediaBox"))
+	trimBoxRe  = regexp.MustCompile(fmt.Sprintf(boxReTpl, "TrimBox"))
+	rotateRe   = regexp.MustCompile(`/Rotate\s*([+-]?\d+)`)
+	contentsRe = regexp.MustCompile(`/Contents\s*(?:(\d+)\s+\d+\s+R|\[([^\]]*)\])`)
+	// page objects of a QDF along with their page number comments
+	pageObjRe   = regexp.MustCompile(`(?ms)^%% Page (\d+)\n%%[^\n]*\n(\d+)\s+\d+\s+obj\n<<\n(.*?)\n^>>\n^endobj`)
 	pageObjRmRe = regexp.MustCompile(
-		`(?m)^\s+/((Bleed|Crop|Media|Trim|Art)Box|Contents|Parent)\s+(\[[^\]]+\]|\d+\s+\d+\s+R)\n`)
+		`(?m)(?:^[ \t]*)?/((Bleed|Crop|Media|Trim|Art)Box|Contents|Parent|Rotate)\s*(\[[^\]]*\]|\d+\s+\d+\s+R|[+-]?\d+)[ \t]*\n?`)
 )
 
+// pdfNum formats f for PDF output, rounded to 0.001pt which is well
+// below what printers resolve. Equal values round the same, so edges
+// shared by tiles still meet exactly.
+func pdfNum(f float64) string {
+	s := strings.TrimRight(strconv.FormatFloat(f, 'f', 3, 64), "0")
+	s = strings.TrimSuffix(s, ".")
+	if s == "-0" {
+		return "0"
+	}
+	return s
+}
+
+// pdfFactor formats a factor of a transformation matrix for PDF output,
+// which is kept to 6 decimals as rounding it moves content far from the
+// origin by much more than pdfNum rounds.
+func pdfFactor(f float64) string {
+	s := strings.TrimRight(strconv.FormatFloat(f, 'f', 6, 64), "0")
+	s = strings.TrimSuffix(s, ".")
+	if s == "-0" {
+		return "0"
+	}
+	return s
+}
+
 // marshal serializes the page to string that can be inserted into
 // PDF document.
 func (p *page) marshal() string {
 	b := &strings.Builder{}
 	fmt.Fprintf(b, "\n%d 0 obj\n<<\n", p.id)
-	fmt.Fprintf(b, "  /MediaBox [ %f %f %f %f ]\n", p.mediaBox.llx, p.mediaBox.lly, p.mediaBox.urx, p.mediaBox.ury)
-	fmt.Fprintf(b, "  /CropBox [ %f %f %f %f ]\n", p.cropBox.llx, p.cropBox.lly, p.cropBox.urx, p.cropBox.ury)
-	fmt.Fprintf(b, "  /BleedBox [ %f %f %f %f ]\n", p.bleedBox.llx, p.bleedBox.lly, p.bleedBox.urx, p.bleedBox.ury)
-	fmt.Fprintf(b, "  /TrimBox [ %f %f %f %f ]\n", p.trimBox.llx, p.trimBox.lly, p.trimBox.urx, p.trimBox.ury)
+	fmt.Fprintf(b, "  /MediaBox [ %s ]\n", p.mediaBox.pdfArray())
+	fmt.Fprintf(b, "  /CropBox [ %s ]\n", p.cropBox.pdfArray())
+	fmt.Fprintf(b, "  /BleedBox [ %s ]\n", p.bleedBox.pdfArray())
+	fmt.Fprintf(b, "  /TrimBox [ %s ]\n", p.trimBox.pdfArray())
 	fmt.Fprintf(b, "  /Contents [ ")
 	for _, cid := range p.contentIds {
 		fmt.Fprintf(b, " %d 0 R ", cid)
 	}
 	fmt.Fprintf(b, " ]\n")
 	fmt.Fprintf(b, "  /Parent %d 0 R\n", p.parentID)
+	if p.rotate != 0 {
+		fmt.Fprintf(b, "  /Rotate %d\n", p.rotate)
+	}
 	b.WriteString(p.raw)
 	fmt.Fprintf(b, "\n>>\nendobj\n")
 	return b.String()
 }
 
+// topLevel returns raw with the dictionaries and strings nested in it
+// blanked out, keeping line breaks, so only the keys of raw itself match
+// at the same offsets as in raw.
+func topLevel(raw string) string {
+	b := []byte(raw)
+	depth, paren, hex := 0, 0, false
+	for i := 0; i < len(b); i++ {
+		start, nested := i, depth > 0 || paren > 0 || hex
+		switch c := b[i]; {
+		case paren > 0:
+			switch c {
+			case '\\':
+				i++
+			case '(':
+				paren++
+			case ')':
+				paren--
+			}
+		case hex:
+			hex = c != '>'
+		case c == '(':
+			paren++
+		case strings.HasPrefix(raw[i:], "<<"):
+			depth++
+			i++
+		case strings.HasPrefix(raw[i:], ">>") && depth > 0:
+			depth--
+			i++
+		case c == '<':
+			hex = true
+		}
+		if nested || depth > 0 || paren > 0 || hex {
+			for j := start; j <= i && j < len(b); j++ {
+				if b[j] != '\n' {
+					b[j] = ' '
+				}
+			}
+		}
+	}
+	return string(b)
+}
+
 // extractAttrs extracts interesting attributes of the page into
 // struct elements and removes them from raw string of the page.
 func (p *page) extractAttrs() error {
@@ -177,31 +870,48 @@ func (p *page) extractAttrs() error {
 		}
 		return i
 	}
-	atof := func(s string) float32 {
-		f, err := strconv.ParseFloat(s, 32)
+	atof := func(s string) float64 {
+		f, err := strconv.ParseFloat(s, 64)
 		if err != nil {
 			panic(err)
 		}
-		return float32(f)
+		return f
+	}
+
+	// Keys of dictionaries nested in the page, such as of annotations,
+	// are left alone
+	top := topLevel(p.raw)
+	find := func(re *regexp.Regexp) []string {
+		loc := re.FindStringSubmatchIndex(top)
+		if loc == nil {
+			return nil
+		}
+		m := make([]string, len(loc)/2)
+		for i := range m {
+			if loc[i*2] >= 0 {
+				m[i] = p.raw[loc[i*2]:loc[i*2+1]]
+			}
+		}
+		return m
 	}
 
 	var m []string
 
-	m = contentsRe.FindStringSubmatch(p.raw)
+	m = find(contentsRe)
 	if m == nil {
 		return fmt.Errorf("cannot find Contents for page:\n%s", p.raw)
 	}
 	if m[1] != "" {
 		p.contentIds = []int{atoi(m[1])}
 	} else {
-		m := regexp.MustCompile(`(?m)^\s+(\d+)\s+\d+\s+R`).FindAllStringSubmatch(m[2], -1)
+		m := regexp.MustCompile(`(\d+)\s+\d+\s+R`).FindAllStringSubmatch(m[2], -1)
 		p.contentIds = []int{}
 		for _, r := range m {
 			p.contentIds = append(p.contentIds, atoi(r[1]))
 		}
 	}
 
-	m = mediaBoxRe.FindStringSubmatch(p.raw)
+	m = find(mediaBoxRe)
 	if m == nil {
 		return fmt.Errorf("cannot find MediaBox for page:\n%s", p.raw)
 	}
@@ -210,7 +920,7 @@ func (p *page) extractAttrs() error {
 		return fmt.Errorf("invalid MediaBox for page:\n%s", p.raw)
 	}
 
-	m = cropBoxRe.FindStringSubmatch(p.raw)
+	m = find(cropBoxRe)
 	if m == nil {
 		p.cropBox = p.mediaBox
 	} else {
@@ -220,7 +930,7 @@ func (p *page) extractAttrs() error {
 		return fmt.Errorf("invalid CropBox for page:\n%s", p.raw)
 	}
 
-	m = bleedBoxRe.FindStringSubmatch(p.raw)
+	m = find(bleedBoxRe)
 	if m == nil {
 		p.bleedBox = p.cropBox
 	} else {
@@ -230,7 +940,7 @@ func (p *page) extractAttrs() error {
 		return fmt.Errorf("invalid BleedBox for page:\n%s", p.raw)
 	}
 
-	m = trimBoxRe.FindStringSubmatch(p.raw)
+	m = find(trimBoxRe)
 	if m == nil {
 		p.trimBox = p.cropBox
 	} else {
@@ -240,50 +950,194 @@ func (p *page) extractAttrs() error {
 		return fmt.Errorf("invalid TrimBox for page:\n%s", p.raw)
 	}
 
+	if m = find(rotateRe); m != nil {
+		p.rotate = atoi(m[1])
+	}
+
 	// Delete all the extracted raw content
 
-	p.raw = pageObjRmRe.ReplaceAllString(p.raw, "")
+	raw := &strings.Builder{}
+	last := 0
+	for _, loc := range pageObjRmRe.FindAllStringIndex(top, -1) {
+		raw.WriteString(p.raw[last:loc[0]])
+		last = loc[1]
+	}
+	raw.WriteString(p.raw[last:])
+	p.raw = raw.String()
 
 	return nil
 }
 
-// cutPageToTiles slices the page into tiles of the given size, setting
+// fitPageToPaper returns a single tile of w x h pt paper showing the
+// whole trim box of the page scaled to fit within the margins, centered.
+func fitPageToPaper(p *page, w, h float64, bleed margins, trimMargin float64) *page {
+	tb := p.trimBox
+	availW := w - bleed.left - bleed.right - trimMargin*2
+	availH := h - bleed.top - bleed.bottom - trimMargin*2
+	scale := availW / (tb.urx - tb.llx)
+	if s := availH / (tb.ury - tb.lly); s < scale {
+		scale = s
+	}
+	tw, th := (tb.urx-tb.llx)*scale, (tb.ury-tb.lly)*scale
+	llx := bleed.left + trimMargin + (availW-tw)/2
+	lly := bleed.bottom + trimMargin + (availH-th)/2
+
+	tile := page{
+		hTiles:     1,
+		vTiles:     1,
+		mediaBox:   rect{0, 0, w, h},
+		bleedBox:   rect{llx - trimMargin, lly - trimMargin, llx + tw + trimMargin, lly + th + trimMargin},
+		trimBox:    rect{llx, lly, llx + tw, lly + th},
+		number:     p.number,
+		label:      p.label,
+		contentIds: append([]int{}, p.contentIds...),
+		rotate:     p.rotate,
+		raw:        p.raw,
+		scale:      scale,
+		offX:       llx - tb.llx*scale,
+		offY:       lly - tb.lly*scale,
+	}
+	tile.contentCM = fmt.Sprintf("%s 0 0 %s %s %s cm ", pdfFactor(scale), pdfFactor(scale), pdfNum(tile.offX), pdfNum(tile.offY))
+	tile.cropBox = tile.mediaBox
+	return &tile
+}
+
+// tileLayout holds how pages are cut into tiles, in pt.
+type tileLayout struct {
+	tileW, tileH float64 // paper less the bleed and trim margins
+	bleed        margins
+	overlap      float64
+	minOverlap   float64 // of pages cut into more than one tile
+	minContent   float64 // warned about if the tiles show less
+	kerf         float64 // cut away at each seam
+	maxAspect    float64 // of the tiles, unless 0
+	skipFitting  bool    // leave pages fitting the paper as they are
+	fill         bool    // scale pages to fill the tiles
+	cols, rows   int     // to pad the grid of tiles to
+	center       bool    // center pages in the padded grid
+}
+
+// cutPageToTiles slices the page into tiles as laid out by l, setting
 // appropriate *Box attributes of the tiles. All other page attributes
 // are copied from the original page.
-func cutPageToTiles(p *page, tileW, tileH, bleedMargin, trimMargin float32) []*page {
+func cutPageToTiles(p *page, l tileLayout) ([]*page, error) {
+	tileW, tileH, bleed, overlap, kerf := l.tileW, l.tileH, l.bleed, l.overlap, l.kerf
+	cols, rows := l.cols, l.rows
+	// Leave pages which already fit on the paper as they are
+	if l.skipFitting &&
+		p.trimBox.urx-p.trimBox.llx <= tileW+bleed.left+bleed.right+trimMargin*2 &&
+		p.trimBox.ury-p.trimBox.lly <= tileH+bleed.top+bleed.bottom+trimMargin*2 {
+		tile := *p
+		tile.hTiles, tile.vTiles = 1, 1
+		tile.contentIds = append([]int{}, p.contentIds...)
+		tile.asIs = true
+		return []*page{&tile}, nil
+	}
 
 	// Adjust tileW and tileH such that all tiles end up with the same dimensions
 	pageWidth := p.trimBox.urx - p.trimBox.llx
 	pageHeight := p.trimBox.ury - p.trimBox.lly
-	hTiles := int(math.Ceil(float64(pageWidth / tileW)))
-	vTiles := int(math.Ceil(float64(pageHeight / tileH)))
-	tileW = pageWidth / float32(hTiles)
-	tileH = pageHeight / float32(vTiles)
+	if pageWidth < tileW && pageHeight < tileH {
+		log.Printf("warning: page %s is smaller than the tiles and won't be cut - use -skip-fitting to leave it as is or -fit-paper to scale it to the paper", pageRef(p))
+	}
+	hTiles, vTiles, o := tileGrid(pageWidth, pageHeight, l)
+	if o != overlap {
+		if (pageWidth > tileW && l.minOverlap >= tileW) || (pageHeight > tileH && l.minOverlap >= tileH) {
+			return nil, fmt.Errorf("tile size is too small for the minimum overlap on page %s", pageRef(p))
+		}
+		log.Printf("increasing the overlap of page %s to %gmm", pageRef(p), l.minOverlap*mmInInch/ptsInInch)
+		overlap = o
+	}
+	// Leave room on the paper for the kerf on both sides
+	tileW -= kerf
+	tileH -= kerf
+	// Boxes of tiles of a scaled page are in the coordinates of the
+	// tiles, with the content scaled about the origin
+	tb := p.trimBox
+	var scale float64
+	if l.fill {
+		scale = (float64(hTiles)*tileW - float64(hTiles-1)*overlap) / pageWidth
+		if s := (float64(vTiles)*tileH - float64(vTiles-1)*overlap) / pageHeight; s < scale {
+			scale = s
+		}
+		pageWidth *= scale
+		pageHeight *= scale
+		tb = rect{tb.llx * scale, tb.lly * scale, tb.urx * scale, tb.ury * scale}
+	}
+	tileW = (pageWidth + float64(hTiles-1)*overlap) / float64(hTiles)
+	tileH = (pageHeight + float64(vTiles-1)*overlap) / float64(vTiles)
+	if tileW < l.minContent || tileH < l.minContent {
+		log.Printf("warning: tiles of page %s only show %.0fmm x %.0fmm of content - use a larger -tile-size for legible tiles",
+			pageRef(p), tileW*mmInInch/ptsInInch, tileH*mmInInch/ptsInInch)
+	}
+
+	if cols < hTiles {
+		cols = hTiles
+	}
+	if rows < vTiles {
+		rows = vTiles
+	}
+
+	// Start of the grid, which may be before the page when it's centered
+	gx, gy := tb.llx, tb.lly
+	if l.center {
+		gx -= float64(cols-hTiles) * (tileW - overlap) / 2
+		gy -= float64(rows-vTiles) * (tileH - overlap) / 2
+	}
 
 	var tilePages []*page
 	tgy := 0
-	for y := 0; y < vTiles; y++ {
-		lly := p.trimBox.lly + float32(y)*tileH
+	for y := 0; y < rows; y++ {
+		lly := gy + float64(y)*(tileH-overlap)
 		tgx := 0
-		for x := 0; x < hTiles; x++ {
-			llx := p.trimBox.llx + float32(x)*tileW
+		for x := 0; x < cols; x++ {
+			llx := gx + float64(x)*(tileW-overlap)
 
 			tile := page{
-				tileX: tgx,
-				tileY: tgy,
+				tileX:  tgx,
+				tileY:  tgy,
+				hTiles: cols,
+				vTiles: rows,
 				mediaBox: rect{
-					llx - trimMargin - bleedMargin,
-					lly - trimMargin - bleedMargin,
-					llx + tileW + trimMargin + bleedMargin,
-					lly + tileH + trimMargin + bleedMargin,
+					llx - trimMargin - bleed.left,
+					lly - trimMargin - bleed.bottom,
+					llx + tileW + trimMargin + bleed.right,
+					lly + tileH + trimMargin + bleed.top,
 				},
 				bleedBox: rect{llx - trimMargin, lly - trimMargin, llx + tileW + trimMargin, lly + tileH + trimMargin},
 				trimBox:  rect{llx, lly, llx + tileW, lly + tileH},
 
 				number:     p.number,
+				label:      p.label,
 				contentIds: append([]int{}, p.contentIds...),
+				rotate:     p.rotate,
 				raw:        p.raw,
 			}
+			if c := tile.trimBox.intersect(tb); (!l.center && (x >= hTiles || y >= vTiles)) || c.llx >= c.urx || c.lly >= c.ury {
+				// Padding beyond the page
+				tile.contentIds = nil
+			}
+			if l.fill {
+				tile.scale = scale
+				tile.contentCM = fmt.Sprintf("%s 0 0 %s 0 0 cm ", pdfFactor(scale), pdfFactor(scale))
+			}
+			if kerf > 0 {
+				interior := allEdges &^ outerEdges(&tile)
+				for _, b := range []*rect{&tile.mediaBox, &tile.bleedBox, &tile.trimBox} {
+					if interior&edgeTop != 0 {
+						b.ury += kerf / 2
+					}
+					if interior&edgeRight != 0 {
+						b.urx += kerf / 2
+					}
+					if interior&edgeBottom != 0 {
+						b.lly -= kerf / 2
+					}
+					if interior&edgeLeft != 0 {
+						b.llx -= kerf / 2
+					}
+				}
+			}
 			tile.cropBox = tile.mediaBox
 			tilePages = append(tilePages, &tile)
 
@@ -292,19 +1146,95 @@ func cutPageToTiles(p *page, tileW, tileH, bleedMargin, trimMargin float32) []*p
 		tgy++
 	}
 
-	return tilePages
+	// Put the tiles in the order of their references
+	sort.SliceStable(tilePages, func(i, j int) bool {
+		ri, ci := tileIndex(tilePages[i])
+		rj, cj := tileIndex(tilePages[j])
+		return ri < rj || (ri == rj && ci < cj)
+	})
+	return tilePages, nil
+}
+
+// tileGrid returns the number of columns and rows of tiles a page of
+// pageWidth x pageHeight pt is cut into, and the overlap between them,
+// as cutPageToTiles works them out.
+func tileGrid(pageWidth, pageHeight float64, l tileLayout) (int, int, float64) {
+	tileW, tileH, overlap, kerf, maxAspect := l.tileW, l.tileH, l.overlap, l.kerf, l.maxAspect
+	// Only seams between tiles need the minimum overlap
+	if overlap < l.minOverlap && (pageWidth > tileW || pageHeight > tileH) {
+		overlap = l.minOverlap
+	}
+	// Leave room on the paper for the kerf on both sides
+	tileW -= kerf
+	tileH -= kerf
+	hTiles := int(math.Ceil((pageWidth - overlap) / (tileW - overlap)))
+	vTiles := int(math.Ceil((pageHeight - overlap) / (tileH - overlap)))
+	if hTiles < 1 {
+		hTiles = 1
+	}
+	if vTiles < 1 {
+		vTiles = 1
+	}
+	// Add columns to tiles too wide, or rows to tiles too tall, for as
+	// long as it brings them closer to maxAspect
+	shape := func(h, v int) (float64, float64) {
+		w := (pageWidth + float64(h-1)*overlap) / float64(h)
+		l := (pageHeight + float64(v-1)*overlap) / float64(v)
+		return w, l
+	}
+	for maxAspect > 0 {
+		w, l := shape(hTiles, vTiles)
+		aspect := math.Max(w/l, l/w)
+		if aspect <= maxAspect {
+			break
+		}
+		h, v := hTiles, vTiles
+		if w > l {
+			h++
+		} else {
+			v++
+		}
+		if w, l = shape(h, v); math.Max(w/l, l/w) >= aspect {
+			break
+		}
+		hTiles, vTiles = h, v
+	}
+	return hTiles, vTiles, overlap
 }
 
 // appendPagesToDoc appends the given pages after all the other objects
 // but before the xref block. It also updates the object ids as it goes
-// starting with startID.
-func appendPagesToDoc(d string, startID int, pages []*page) string {
+// starting with startID. Pages taking the place of an original page
+// replace it instead, so references to it stay valid.
+func appendPagesToDoc(d string, startID int, pages []*page) (string, error) {
 	var b strings.Builder
 	for pi, p := range pages {
+		if p.origID != 0 {
+			p.id = p.origID
+			r := regexp.MustCompile(fmt.Sprintf(`(?ms)^%d 0 obj\n<<\n.*?^endobj\n`, p.id))
+			loc := r.FindStringIndex(d)
+			if loc == nil {
+				return "", fmt.Errorf("cannot find page object %d", p.id)
+			}
+			d = d[:loc[0]] + strings.TrimPrefix(p.marshal(), "\n") + d[loc[1]:]
+			continue
+		}
 		p.id = pi + startID
 		b.WriteString(p.marshal())
 	}
-	return strings.Replace(d, "\nxref\n", "\n"+b.String()+"\n\nxref\n", 1)
+	return insertObjects(d, b.String()+"\n")
+}
+
+// insertObjects returns the document with objs added after all of its
+// objects, right before the last xref section. Documents updated in
+// place may have several, of which only the last is followed by the
+// trailer pointing at it.
+func insertObjects(d, objs string) (string, error) {
+	i := strings.LastIndex(d, "\nxref\n")
+	if i < 0 || !strings.Contains(d[i:], "\nstartxref") {
+		return "", errors.New("cannot find the xref section at the end of the document")
+	}
+	return d[:i] + "\n" + objs + d[i:], nil
 }
 
 // replaceAllDocPagesWith updates the first node of the page tree with array
@@ -324,256 +1254,2297 @@ func replaceAllDocPagesWith(d string, pages []*page, pageTreeID int) string {
 	return d
 }
 
-// getAllPages returns all the page objects in the document in order
-// they appear in input.
-func getAllPages(d string) []*page {
-	pages := []*page{}
-	// Match all the pages
-	pageRe := regexp.MustCompile(`(?ms)^%% Page (\d+)\n%%[^\n]*\n\d+\s+\d+\s+obj\n<<\n(.*?)\n^>>\n^endobj`)
+// createHatchPattern returns a tiling pattern object of light gray
+// diagonal lines.
+func createHatchPattern(id int) string {
+	s := float64(hatchSpacing)
+	stream := fmt.Sprintf("0.75 G 0.5 w 0 0 m %s %s l S -1 %s m 1 %s l S %s -1 m %s 1 l S",
+		pdfNum(s), pdfNum(s), pdfNum(s-1), pdfNum(s+1), pdfNum(s-1), pdfNum(s+1))
+	return fmt.Sprintf(
+		"%d 0 obj\n<< /Type /Pattern /PatternType 1 /PaintType 1 /TilingType 1 /BBox [ 0 0 %s %s ] /XStep %s /YStep %s /Resources << >> /Length %d >> stream\n%sendstream\nendobj\n",
+		id, pdfNum(s), pdfNum(s), pdfNum(s), pdfNum(s), len(stream), stream)
+}
 
-	pageM := pageRe.FindAllStringSubmatch(d, -1)
-	for _, pm := range pageM {
-		pNum, _ := strconv.Atoi(pm[1])
-		p := page{number: pNum, raw: pm[2]}
-		if err := p.extractAttrs(); err != nil {
-			log.Print(err)
-			continue
+// addPageResource makes the object id available to the content of the
+// page under name in the given resource category (e.g. Pattern). It's
+// added either to the resources in the page itself or to the objects
+// they refer to.
+func addPageResource(d string, p *page, category, name string, id int) string {
+	entry := fmt.Sprintf("/%s %d 0 R", name, id)
+	res := getDictEntry(p.raw, "Resources")
+	if res == "" {
+		p.raw += fmt.Sprintf("\n  /Resources << /%s << %s >> >>", category, entry)
+		return d
+	}
+	if m := regexp.MustCompile(`^\s*/Resources\s+(\d+)\s+\d+\s+R`).FindStringSubmatch(res); m != nil {
+		resID, _ := strconv.Atoi(m[1])
+		r := regexp.MustCompile(fmt.Sprintf(`(?ms)^%d 0 obj\n<<\n(.*?)^>>\n`, resID))
+		loc := r.FindStringSubmatchIndex(d)
+		if loc == nil {
+			return d
 		}
-		pages = append(pages, &p)
+		dict, d := addResourceEntry(d, d[loc[2]:loc[3]], "  ", category, entry)
+		return d[:loc[2]] + dict + d[loc[3]:]
 	}
-
-	return pages
+	// Inline resources
+	i, j := strings.Index(res, "<<\n"), strings.LastIndex(res, "  >>")
+	if i < 0 || j < i {
+		return d
+	}
+	dict, d := addResourceEntry(d, res[i+3:j], "    ", category, entry)
+	p.raw = strings.Replace(p.raw, res, res[:i+3]+dict+res[j:], 1)
+	return d
 }
 
-// numToDoubleAlpha converts a given integer to a 26 base number
-// system with digits each between A-Z
-func numToAlpha(n int) string {
-	s := []byte(strconv.FormatInt(int64(n), 26))
-	for i, c := range s {
-		if c < 'a' {
-			s[i] = byte('A' + (c - '0'))
-		} else {
-			s[i] = byte('A' + 10 + (c - 'a'))
+// addResourceEntry adds entry to the category of the resource dictionary
+// with the given body, whose keys are indented by indent. It returns the
+// new body along with the document, which is changed if the category
+// is an object of its own.
+func addResourceEntry(d, dict, indent, category, entry string) (string, string) {
+	if strings.Contains(dict, entry) {
+		return dict, d
+	}
+	m := regexp.MustCompile(fmt.Sprintf(`(?m)^%s/%s\s*(?:(<<)|(\d+)\s+\d+\s+R)`, indent, category)).FindStringSubmatchIndex(dict)
+	switch {
+	case m == nil:
+		dict += fmt.Sprintf("%s/%s << %s >>\n", indent, category, entry)
+	case m[2] >= 0:
+		dict = dict[:m[3]] + " " + entry + dict[m[3]:]
+	default:
+		id := dict[m[4]:m[5]]
+		r := regexp.MustCompile(fmt.Sprintf(`(?ms)^(%s 0 obj\n<<\n)(.*?^>>\n)`, id))
+		if loc := r.FindStringSubmatchIndex(d); loc != nil && !strings.Contains(d[loc[4]:loc[5]], entry) {
+			d = d[:loc[3]] + "  " + entry + "\n" + d[loc[3]:]
 		}
 	}
-	return string(s)
+	return dict, d
 }
 
-// createOverlayForPage returns a PDF object which contains:
-// - white opaque margin up to bleedMargin
-// - trim marks up to bleedMargin
-// - other printmarks such as tile/page number
+// getCatalogID returns the object id of the document catalog.
+func getCatalogID(d string) (int, error) {
+	m := regexp.MustCompile(`(?m)^\s*/Root\s+(\d+)\s+\d+\s+R`).FindAllStringSubmatch(d, -1)
+	if m == nil {
+		return 0, fmt.Errorf("cannot find the document catalog")
+	}
+	return strconv.Atoi(m[len(m)-1][1])
+}
+
+// setObjectEntry sets the key of the dictionary object with the given
+// id to value, replacing any existing value of key.
+func setObjectEntry(d string, id int, key, value string) (string, error) {
+	r := regexp.MustCompile(fmt.Sprintf(`(?ms)^%d 0 obj\n<<\n(.*?)^>>\n`, id))
+	loc := r.FindStringSubmatchIndex(d)
+	if loc == nil {
+		return "", fmt.Errorf("cannot find dictionary object %d", id)
+	}
+	dict := removeDictEntry(d[loc[2]:loc[3]], key)
+	dict += fmt.Sprintf("  /%s %s\n", key, value)
+	return d[:loc[2]] + dict + d[loc[3]:], nil
+}
+
+// removeDictEntry removes the key and its value from the body of a top
+// level QDF dictionary.
+func removeDictEntry(dict, key string) string {
+	// Value lines are indented further or close the value at the key's
+	// indentation
+	keyRe := regexp.MustCompile(fmt.Sprintf(`(?m)^  /%s\b.*(?:\n|$)(?:^ {3,}.*(?:\n|$)|^  [>\]].*(?:\n|$))*`, key))
+	return keyRe.ReplaceAllString(dict, "")
+}
+
+// getDictEntry returns the key and its value as they appear in the body
+// of a top level QDF dictionary, or an empty string if key isn't set.
+func getDictEntry(dict, key string) string {
+	keyRe := regexp.MustCompile(fmt.Sprintf(`(?m)^  /%s\b.*(?:\n|$)(?:^ {3,}.*(?:\n|$)|^  [>\]].*(?:\n|$))*`, key))
+	e := keyRe.FindString(dict)
+	if e != "" && !strings.HasSuffix(e, "\n") {
+		e += "\n"
+	}
+	return e
+}
+
+// setCatalogEntry sets the key of the document catalog to value,
+// replacing any existing value of key.
+func setCatalogEntry(d string, key, value string) (string, error) {
+	id, err := getCatalogID(d)
+	if err != nil {
+		return "", err
+	}
+	return setObjectEntry(d, id, key, value)
+}
+
+// pdfString returns s as a PDF text string.
+func pdfString(s string) string {
+	for _, c := range s {
+		if c > unicode.MaxASCII {
+			b := &strings.Builder{}
+			b.WriteString("<FEFF")
+			for _, u := range utf16.Encode([]rune(s)) {
+				fmt.Fprintf(b, "%04X", u)
+			}
+			b.WriteString(">")
+			return b.String()
+		}
+	}
+	r := strings.NewReplacer(`\`, `\\`, `(`, `\(`, `)`, `\)`, "\r", `\r`, "\n", `\n`)
+	return "(" + r.Replace(s) + ")"
+}
+
+// createPageLabels returns a page label number tree object labeling
+// each of the given pages with its tile reference.
+func createPageLabels(id int, pages []*page) string {
+	multiPage := false
+	for _, p := range pages {
+		if p.number != pages[0].number {
+			multiPage = true
+			break
+		}
+	}
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%d 0 obj\n<< /Nums [\n", id)
+	for i, p := range pages {
+		if p.name != "" && p.number == 0 {
+			fmt.Fprintf(b, "%d << /P %s >>\n", i, pdfString(p.name))
+			continue
+		}
+		if p.name != "" {
+			fmt.Fprintf(b, "%d << /P %s >>\n", i, pdfString(fmt.Sprintf("%s %d", p.name, p.number)))
+			continue
+		}
+		// Viewers number the column, which matches that of tileRef
+		row, _ := tileRef(p)
+		_, col := tileIndex(p)
+		prefix := *pageLabelPrefix + row
+		if multiPage {
+			prefix = fmt.Sprintf("%s%d-%s", *pageLabelPrefix, p.number, row)
+		}
+		fmt.Fprintf(b, "%d << /P %s /S /D /St %d >>\n", i, pdfString(prefix), col+1)
+	}
+	b.WriteString("] >>\nendobj\n")
+	return b.String()
+}
+
+// getSourcePageLabels returns the labels the /PageLabels number tree of
+// the document gives to each of the first n pages. Pages without a
+// label are given an empty string.
+func getSourcePageLabels(d string, n int) []string {
+	labels := make([]string, n)
+	catID, err := getCatalogID(d)
+	if err != nil {
+		return labels
+	}
+	objRe := func(id int) *regexp.Regexp {
+		return regexp.MustCompile(fmt.Sprintf(`(?ms)^%d 0 obj\n<<\n(.*?)^>>\n`, id))
+	}
+	m := objRe(catID).FindStringSubmatch(d)
+	if m == nil {
+		return labels
+	}
+	e := getDictEntry(m[1], "PageLabels")
+	if e == "" {
+		return labels
+	}
+	refRe := regexp.MustCompile(`^\s*/PageLabels\s+(\d+)\s+\d+\s+R`)
+	if rm := refRe.FindStringSubmatch(e); rm != nil {
+		id, _ := strconv.Atoi(rm[1])
+		if m := objRe(id).FindStringSubmatch(d); m != nil {
+			e = m[1]
+		}
+	}
+
+	// Collect the page index and label dictionary pairs of all the
+	// nodes of the number tree
+	type labelRange struct {
+		start int
+		dict  string
+	}
+	var ranges []labelRange
+	seen := map[int]bool{}
+	var walk func(node string)
+	walk = func(node string) {
+		if nums := regexp.MustCompile(`(?s)/Nums\s*\[(.*?)\]`).FindStringSubmatch(node); nums != nil {
+			pairRe := regexp.MustCompile(`(?s)(\d+)\s*(?:<<(.*?)>>|(\d+)\s+\d+\s+R)`)
+			for _, pm := range pairRe.FindAllStringSubmatch(nums[1], -1) {
+				start, _ := strconv.Atoi(pm[1])
+				dict := pm[2]
+				if pm[3] != "" {
+					id, _ := strconv.Atoi(pm[3])
+					if m := objRe(id).FindStringSubmatch(d); m != nil {
+						dict = m[1]
+					}
+				}
+				ranges = append(ranges, labelRange{start, dict})
+			}
+		}
+		if kids := regexp.MustCompile(`/Kids\s*\[([^\]]*)\]`).FindStringSubmatch(node); kids != nil {
+			for _, r := range regexp.MustCompile(`(\d+)\s+\d+\s+R`).FindAllStringSubmatch(kids[1], -1) {
+				id, _ := strconv.Atoi(r[1])
+				if seen[id] {
+					continue
+				}
+				seen[id] = true
+				if m := objRe(id).FindStringSubmatch(d); m != nil {
+					walk(m[1])
+				}
+			}
+		}
+	}
+	walk(e)
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+
+	styleRe := regexp.MustCompile(`/S\s*/([DRrAa])`)
+	prefixRe := regexp.MustCompile(`/P\s*\(((?:\\.|[^\\)])*)\)`)
+	startRe := regexp.MustCompile(`/St\s+(\d+)`)
+	unescape := strings.NewReplacer(`\(`, "(", `\)`, ")", `\\`, `\`)
+	for i, r := range ranges {
+		end := n
+		if i+1 < len(ranges) && ranges[i+1].start < end {
+			end = ranges[i+1].start
+		}
+		style := ""
+		if m := styleRe.FindStringSubmatch(r.dict); m != nil {
+			style = m[1]
+		}
+		prefix := ""
+		if m := prefixRe.FindStringSubmatch(r.dict); m != nil {
+			prefix = unescape.Replace(m[1])
+		}
+		st := 1
+		if m := startRe.FindStringSubmatch(r.dict); m != nil {
+			st, _ = strconv.Atoi(m[1])
+		}
+		for p := r.start; p < end; p++ {
+			labels[p] = prefix + formatPageLabel(style, st+p-r.start)
+		}
+	}
+	return labels
+}
+
+// formatPageLabel returns the page label number n in the given /PageLabels
+// numbering style.
+func formatPageLabel(style string, n int) string {
+	switch style {
+	case "D":
+		return strconv.Itoa(n)
+	case "R":
+		return toRoman(n)
+	case "r":
+		return strings.ToLower(toRoman(n))
+	case "A", "a":
+		// AA follows Z, then BB and so on
+		l := strings.Repeat(string(rune('A'+(n-1)%26)), (n-1)/26+1)
+		if style == "a" {
+			l = strings.ToLower(l)
+		}
+		return l
+	}
+	return ""
+}
+
+// toRoman returns n in uppercase roman numerals.
+func toRoman(n int) string {
+	vals := []int{1000, 900, 500, 400, 100, 90, 50, 40, 10, 9, 5, 4, 1}
+	syms := []string{"M", "CM", "D", "CD", "C", "XC", "L", "XL", "X", "IX", "V", "IV", "I"}
+	b := &strings.Builder{}
+	for i, v := range vals {
+		for ; n >= v; n -= v {
+			b.WriteString(syms[i])
+		}
+	}
+	return b.String()
+}
+
+// pageRef returns the reference of the original page of a tile as
+// shown on its labels.
+func pageRef(p *page) string {
+	if p.label != "" {
+		return strings.ToUpper(p.label)
+	}
+	return strconv.Itoa(p.number)
+}
+
+// remapRefs replaces references to object ids in keys with the given
+// names using the given mapping.
+func remapRefs(d string, keys []string, ids map[int]int) string {
+	r := regexp.MustCompile(fmt.Sprintf(`(/(?:%s)\s+)(\d+)(\s+\d+\s+R)`, strings.Join(keys, "|")))
+	return r.ReplaceAllStringFunc(d, func(s string) string {
+		m := r.FindStringSubmatch(s)
+		id, _ := strconv.Atoi(m[2])
+		if newID, ok := ids[id]; ok {
+			return fmt.Sprintf("%s%d 0 R", m[1], newID)
+		}
+		return s
+	})
+}
+
+// remapOpenAction points the destination the document opens at, given
+// directly or by a go-to action, at the page ids maps its page to. The
+// original page would otherwise be kept in the output, outside of the
+// page tree.
+func remapOpenAction(d string, ids map[int]int) (string, error) {
+	catID, err := getCatalogID(d)
+	if err != nil {
+		return "", err
+	}
+	objRe := func(id int) *regexp.Regexp {
+		return regexp.MustCompile(fmt.Sprintf(`(?ms)^%d 0 obj\n<<\n(.*?)^>>\n`, id))
+	}
+	m := objRe(catID).FindStringSubmatch(d)
+	if m == nil {
+		return d, nil
+	}
+	id, key, e := catID, "OpenAction", getDictEntry(m[1], "OpenAction")
+	if rm := regexp.MustCompile(`^\s*/OpenAction\s+(\d+)\s+\d+\s+R`).FindStringSubmatch(e); rm != nil {
+		id, _ = strconv.Atoi(rm[1])
+		am := objRe(id).FindStringSubmatch(d)
+		if am == nil {
+			return d, nil
+		}
+		key, e = "D", getDictEntry(am[1], "D")
+	}
+	// Destinations are arrays starting with the page
+	dm := regexp.MustCompile(`^\s*/\w+\s*\[\s*(\d+)\s+\d+\s+R`).FindStringSubmatchIndex(e)
+	if dm == nil {
+		return d, nil
+	}
+	pageID, _ := strconv.Atoi(e[dm[2]:dm[3]])
+	newID, ok := ids[pageID]
+	if !ok {
+		return d, nil
+	}
+	e = e[:dm[2]] + strconv.Itoa(newID) + e[dm[3]:]
+	value := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(e), "/"+key))
+	return setObjectEntry(d, id, key, value)
+}
+
+// getAllPages returns all the page objects in the document in reading
+// order, numbered from 1.
+func getAllPages(d string) []*page {
+	pages := []*page{}
+	// Match all the pages
+	pageM := pageObjRe.FindAllStringSubmatch(d, -1)
+	for _, pm := range pageM {
+		pNum, _ := strconv.Atoi(pm[1])
+		pID, _ := strconv.Atoi(pm[2])
+		p := page{id: pID, number: pNum, raw: pm[3]}
+		if err := p.extractAttrs(); err != nil {
+			log.Print(err)
+			continue
+		}
+		pages = append(pages, &p)
+	}
+
+	// The comments follow the order qpdf found the pages in, which may
+	// not be the reading order of an unusual page tree, so number the
+	// pages by walking the tree instead where possible
+	pageTreeID, err := getPageTreeID(d)
+	if err != nil {
+		return pages
+	}
+	ids := map[int]*page{}
+	for _, p := range pages {
+		ids[p.id] = p
+	}
+	order := walkPageTree(d, pageTreeID, ids, map[int]bool{})
+	if len(order) != len(pages) {
+		log.Print("warning: page tree does not match the pages, using the page order of the file")
+		return pages
+	}
+	for i, p := range order {
+		p.number = i + 1
+	}
+	return order
+}
+
+// getPageTreeID returns the object id of the root of the page tree.
+func getPageTreeID(d string) (int, error) {
+	m := regexp.MustCompile(`(?m)^\s+/Pages\s+(\d+)\s+\d+\s+R`).FindStringSubmatch(d)
+	if m == nil {
+		return 0, fmt.Errorf("cannot find root page tree")
+	}
+	return strconv.Atoi(m[1])
+}
+
+// walkPageTree returns the pages (from ids) under the page tree node id
+// in reading order, following the Kids of intermediate nodes.
+func walkPageTree(d string, id int, ids map[int]*page, seen map[int]bool) []*page {
+	if p, ok := ids[id]; ok {
+		return []*page{p}
+	}
+	if seen[id] {
+		return nil
+	}
+	seen[id] = true
+	m := regexp.MustCompile(fmt.Sprintf(`(?ms)^%d 0 obj\n<<\n(.*?)^>>\n`, id)).FindStringSubmatch(d)
+	if m == nil {
+		return nil
+	}
+	kids := regexp.MustCompile(`/Kids\s*\[([^\]]*)\]`).FindStringSubmatch(m[1])
+	if kids == nil {
+		return nil
+	}
+	var pages []*page
+	for _, r := range regexp.MustCompile(`(\d+)\s+\d+\s+R`).FindAllStringSubmatch(kids[1], -1) {
+		kid, _ := strconv.Atoi(r[1])
+		pages = append(pages, walkPageTree(d, kid, ids, seen)...)
+	}
+	return pages
+}
+
+// inheritableKeys are the page attributes which may be set on page tree
+// nodes instead of the pages themselves.
+var inheritableKeys = []string{"Resources", "MediaBox", "CropBox", "Rotate"}
+
+// flattenPageTree turns a multi-level page tree into a single root node
+// referencing all the pages in reading order. Attributes inherited from
+// intermediate nodes are copied to the pages and the intermediate nodes
+// are replaced with null so no stale part of the tree is left behind.
+func flattenPageTree(d string) (string, error) {
+	rootID, err := getPageTreeID(d)
+	if err != nil {
+		// Leave it to the callers to complain about
+		return d, nil
+	}
+	var pageIDs, nodeIDs []int
+	inherited := map[int]map[string]string{}
+	seen := map[int]bool{}
+	var walk func(id int, attrs map[string]string)
+	walk = func(id int, attrs map[string]string) {
+		if seen[id] {
+			return
+		}
+		seen[id] = true
+		m := regexp.MustCompile(fmt.Sprintf(`(?ms)^%d 0 obj\n<<\n(.*?)^>>\n`, id)).FindStringSubmatch(d)
+		if m == nil {
+			return
+		}
+		kids := regexp.MustCompile(`/Kids\s*\[([^\]]*)\]`).FindStringSubmatch(m[1])
+		if kids == nil {
+			pageIDs = append(pageIDs, id)
+			inherited[id] = attrs
+			return
+		}
+		if id != rootID {
+			nodeIDs = append(nodeIDs, id)
+			// Nearer nodes take precedence over the ones above them
+			a := map[string]string{}
+			for k, v := range attrs {
+				a[k] = v
+			}
+			for _, k := range inheritableKeys {
+				if e := getDictEntry(m[1], k); e != "" {
+					a[k] = e
+				}
+			}
+			attrs = a
+		}
+		for _, r := range regexp.MustCompile(`(\d+)\s+\d+\s+R`).FindAllStringSubmatch(kids[1], -1) {
+			kid, _ := strconv.Atoi(r[1])
+			walk(kid, attrs)
+		}
+	}
+	walk(rootID, map[string]string{})
+	if len(nodeIDs) == 0 {
+		return d, nil
+	}
+
+	pages := make([]*page, len(pageIDs))
+	for i, id := range pageIDs {
+		r := regexp.MustCompile(fmt.Sprintf(`(?ms)^%d 0 obj\n<<\n(.*?)^>>\n`, id))
+		loc := r.FindStringSubmatchIndex(d)
+		dict := d[loc[2]:loc[3]]
+		for _, k := range inheritableKeys {
+			if e, ok := inherited[id][k]; ok && getDictEntry(dict, k) == "" {
+				dict += e
+			}
+		}
+		d = d[:loc[2]] + dict + d[loc[3]:]
+		if d, err = setObjectEntry(d, id, "Parent", fmt.Sprintf("%d 0 R", rootID)); err != nil {
+			return "", err
+		}
+		pages[i] = &page{id: id}
+	}
+	for _, id := range nodeIDs {
+		r := regexp.MustCompile(fmt.Sprintf(`(?ms)^(%d 0 obj\n)<<\n.*?^>>\n`, id))
+		d = r.ReplaceAllString(d, "${1}null\n")
+	}
+	return replaceAllDocPagesWith(d, pages, rootID), nil
+}
+
+// tileRef returns the row and column of the tile as shown on its
+// labels. All labels of a tile are to be derived from this so that the
+// tile itself, the assembly map and the contact sheet always agree.
+func tileRef(p *page) (row, col string) {
+	r, c := tileIndex(p)
+	return numToAlpha(r), strconv.Itoa(c + 1)
+}
+
+// tileIndex returns the row and column of the tile counting from 0 at
+// the corner of the page set by -origin.
+func tileIndex(p *page) (row, col int) {
+	row, col = p.tileY, p.tileX
+	if strings.HasPrefix(*tileOrigin, "top-") {
+		row = p.vTiles - 1 - row
+	}
+	if strings.HasSuffix(*tileOrigin, "-right") {
+		col = p.hTiles - 1 - col
+	}
+	return row, col
+}
+
+// tileLabel returns the row and column of the tile as one string (e.g.
+// B3).
+func tileLabel(p *page) string {
+	row, col := tileRef(p)
+	return row + col
+}
+
+// numToDoubleAlpha converts a given integer to a 26 base number
+// system with digits each between A-Z
+func numToAlpha(n int) string {
+	s := []byte(strconv.FormatInt(int64(n), 26))
+	for i, c := range s {
+		if c < 'a' {
+			s[i] = byte('A' + (c - '0'))
+		} else {
+			s[i] = byte('A' + 10 + (c - 'a'))
+		}
+	}
+	return string(s)
+}
+
+// streamObject returns a PDF stream object with the given id and
+// content.
+func streamObject(id int, stream string) string {
+	return fmt.Sprintf("%d 0 obj\n<< /Length %d >> stream\n%sendstream\nendobj\n",
+		id, len(stream), stream)
+}
+
+// grayMarks replaces the RGB color operators of mark drawing with their
+// gray equivalents, so single color printers don't render black as a
+// mix of inks.
+var grayMarks = strings.NewReplacer(
+	"0 0 0 rg", "0 g",
+	"1 1 1 rg", "1 g",
+	"1 1 1 RG", "1 G",
+	"0 0 0 RG", "0 G",
+)
+
+// markCaps are the line cap styles of the PDF J operator by their
+// -mark-cap names.
+var markCaps = map[string]int{
+	"butt":   0,
+	"round":  1,
+	"square": 2,
+}
+
+// markStream returns a stream object of print marks, using gray color
+// operators if -grayscale-marks is set.
+func markStream(id int, stream string) string {
+	if *grayscaleMarks {
+		stream = grayMarks.Replace(stream)
+	}
+	return streamObject(id, stream)
+}
+
+// bleedMirrors returns the graphics commands which set up clipping and
+// transformation for mirroring the content of the original page along
+// its edges into the bleed of the given tile. Each is to be followed by
+// the page content.
+func bleedMirrors(p *page) []string {
+	bb, tb := p.bleedBox, p.trimBox
+	edges := outerEdges(p)
+
+	// Span of the content not on the outer edges which gets mirrored
+	inner := bb
+	if edges&edgeLeft != 0 {
+		inner.llx = tb.llx
+	}
+	if edges&edgeRight != 0 {
+		inner.urx = tb.urx
+	}
+	if edges&edgeBottom != 0 {
+		inner.lly = tb.lly
+	}
+	if edges&edgeTop != 0 {
+		inner.ury = tb.ury
+	}
+
+	type span struct {
+		from, to float64
+		// mirror transform
+		scale, offset float64
+	}
+	hSpans := []span{{inner.llx, inner.urx, 1, 0}}
+	if edges&edgeLeft != 0 {
+		hSpans = append(hSpans, span{bb.llx, tb.llx, -1, tb.llx * 2})
+	}
+	if edges&edgeRight != 0 {
+		hSpans = append(hSpans, span{tb.urx, bb.urx, -1, tb.urx * 2})
+	}
+	vSpans := []span{{inner.lly, inner.ury, 1, 0}}
+	if edges&edgeBottom != 0 {
+		vSpans = append(vSpans, span{bb.lly, tb.lly, -1, tb.lly * 2})
+	}
+	if edges&edgeTop != 0 {
+		vSpans = append(vSpans, span{tb.ury, bb.ury, -1, tb.ury * 2})
+	}
+
+	var mirrors []string
+	for i, h := range hSpans {
+		for j, v := range vSpans {
+			if i == 0 && j == 0 {
+				continue // not mirrored
+			}
+			mirrors = append(mirrors, fmt.Sprintf("q %s %s %s %s re W n %s 0 0 %s %s %s cm ",
+				pdfNum(h.from), pdfNum(v.from), pdfNum(h.to-h.from), pdfNum(v.to-v.from), pdfFactor(h.scale), pdfFactor(v.scale), pdfNum(h.offset), pdfNum(v.offset)))
+		}
+	}
+	return mirrors
+}
+
+// tile edges
+const (
+	edgeTop = 1 << iota
+	edgeRight
+	edgeBottom
+	edgeLeft
+
+	allEdges = edgeTop | edgeRight | edgeBottom | edgeLeft
+)
+
+// outerEdges returns the edges of the tile which lie on the edges of
+// the original page.
+func outerEdges(p *page) int {
+	var edges int
+	if p.tileY == p.vTiles-1 {
+		edges |= edgeTop
+	}
+	if p.tileX == p.hTiles-1 {
+		edges |= edgeRight
+	}
+	if p.tileY == 0 {
+		edges |= edgeBottom
+	}
+	if p.tileX == 0 {
+		edges |= edgeLeft
+	}
+	if p.flipped {
+		// The content is upside down on the paper
+		edges = (edges&(edgeTop|edgeRight))<<2 | (edges&(edgeBottom|edgeLeft))>>2
+	}
+	return edges
+}
+
+// scaleBarMarks returns the drawing of a scale bar for -scale-bar,
+// labelled with the length it stands for and the scale, starting at the
+// origin and centered on it vertically, along with its width in pt. The
+// bar is a round length of up to 50mm or a third of the tile.
+func scaleBarMarks(p *page) (string, float64) {
+	vch := float64(vecCharHeight)
+	// Length in mm on paper of a mm of the drawing
+	paperMM := float64(1)
+	if p.scale != 0 {
+		paperMM = p.scale
+	}
+	maxMM := (p.trimBox.urx - p.trimBox.llx) / 3 * mmInInch / ptsInInch
+	if maxMM > 50 {
+		maxMM = 50
+	}
+	// Largest 1, 2 or 5 times a power of ten of mm in reality which fits
+	maxReal := maxMM / paperMM * float64(scaleBar)
+	pow := math.Pow(10, math.Floor(math.Log10(maxReal)))
+	realMM := pow
+	for _, m := range []float64{2, 5} {
+		if m*pow <= maxReal {
+			realMM = m * pow
+		}
+	}
+	var length string
+	switch {
+	case realMM >= 1e6:
+		length = fmt.Sprintf("%g KM", realMM/1e6)
+	case realMM >= 1e3:
+		length = fmt.Sprintf("%g M", realMM/1e3)
+	case realMM >= 10:
+		length = fmt.Sprintf("%g CM", realMM/10)
+	default:
+		length = fmt.Sprintf("%g MM", realMM)
+	}
+	label := length + " AT " + scaleBar.String()
+	barW := realMM / float64(scaleBar) * paperMM * ptsInInch / mmInInch
+	// Alternate filled and empty halves as on maps
+	bar := fmt.Sprintf(` q 0 0 0 rg 0 0 0 RG %s w
+    0 %s %s %s re f 0 %s %s %s re S
+    q 1 0 0 1 %s 0 cm %s Q
+  Q `,
+		pdfNum(trimMarkLineWidth),
+		pdfNum(-vch/4), pdfNum(barW/2), pdfNum(vch/2), pdfNum(-vch/4), pdfNum(barW), pdfNum(vch/2),
+		pdfNum(barW+vch/2), strToVecChars(label, 1, 0),
+	)
+	return bar, barW + vch/2 + vecCharsWidth(label)
+}
+
+// registrationMarks returns a PDF path stroking a registration target in
+// the margin off each corner of the tile between two of the given edges.
+func registrationMarks(p *page, edges int) string {
+	mb, bb := p.mediaBox, p.bleedBox
+	b := &strings.Builder{}
+	target := func(x, y, r float64) {
+		// Approximate the circle with a bezier curve per quadrant
+		k := r * 0.5523
+		fmt.Fprintf(b, " %s %s m %s %s %s %s %s %s c", pdfNum(x+r), pdfNum(y), pdfNum(x+r), pdfNum(y+k), pdfNum(x+k), pdfNum(y+r), pdfNum(x), pdfNum(y+r))
+		fmt.Fprintf(b, " %s %s %s %s %s %s c", pdfNum(x-k), pdfNum(y+r), pdfNum(x-r), pdfNum(y+k), pdfNum(x-r), pdfNum(y))
+		fmt.Fprintf(b, " %s %s %s %s %s %s c", pdfNum(x-r), pdfNum(y-k), pdfNum(x-k), pdfNum(y-r), pdfNum(x), pdfNum(y-r))
+		fmt.Fprintf(b, " %s %s %s %s %s %s c S", pdfNum(x+k), pdfNum(y-r), pdfNum(x+r), pdfNum(y-k), pdfNum(x+r), pdfNum(y))
+		fmt.Fprintf(b, " %s %s m %s %s l S", pdfNum(x-r*1.5), pdfNum(y), pdfNum(x+r*1.5), pdfNum(y))
+		fmt.Fprintf(b, " %s %s m %s %s l S", pdfNum(x), pdfNum(y-r*1.5), pdfNum(x), pdfNum(y+r*1.5))
+	}
+	for _, c := range []struct {
+		edges                  int
+		x, y, marginX, marginY float64
+	}{
+		{edgeTop | edgeLeft, (mb.llx + bb.llx) / 2, (mb.ury + bb.ury) / 2, bb.llx - mb.llx, mb.ury - bb.ury},
+		{edgeTop | edgeRight, (mb.urx + bb.urx) / 2, (mb.ury + bb.ury) / 2, mb.urx - bb.urx, mb.ury - bb.ury},
+		{edgeBottom | edgeRight, (mb.urx + bb.urx) / 2, (mb.lly + bb.lly) / 2, mb.urx - bb.urx, bb.lly - mb.lly},
+		{edgeBottom | edgeLeft, (mb.llx + bb.llx) / 2, (mb.lly + bb.lly) / 2, bb.llx - mb.llx, bb.lly - mb.lly},
+	} {
+		if edges&c.edges != c.edges {
+			continue
+		}
+		// Keep clear of the trim marks and the edge of the paper
+		r := float64(vecCharHeight) / 2
+		if m := c.marginX / 4; m < r {
+			r = m
+		}
+		if m := c.marginY / 4; m < r {
+			r = m
+		}
+		target(c.x, c.y, r)
+	}
+	return b.String()
+}
+
+// trimMarks returns a PDF path stroking the trim marks of the given
+// edges of the tile.
+func trimMarks(p *page, edges int) string {
+	mb, bb, tb := p.mediaBox, p.bleedBox, p.trimBox
+	b := &strings.Builder{}
+	line := func(x1, y1, x2, y2 float64) {
+		fmt.Fprintf(b, " %s %s m %s %s l S", pdfNum(x1), pdfNum(y1), pdfNum(x2), pdfNum(y2))
+	}
+	gap := markGap.pt()
+	if *longTrimMarks {
+		// Leave the gap around the trim corners the lines pass through
+		hLine := func(y float64) {
+			if gap == 0 {
+				line(mb.llx-1, y, mb.urx+1, y)
+				return
+			}
+			line(mb.llx-1, y, tb.llx-gap, y)
+			line(tb.llx+gap, y, tb.urx-gap, y)
+			line(tb.urx+gap, y, mb.urx+1, y)
+		}
+		vLine := func(x float64) {
+			if gap == 0 {
+				line(x, mb.lly-1, x, mb.ury+1)
+				return
+			}
+			line(x, mb.lly-1, x, tb.lly-gap)
+			line(x, tb.lly+gap, x, tb.ury-gap)
+			line(x, tb.ury+gap, x, mb.ury+1)
+		}
+		if edges&edgeBottom != 0 {
+			hLine(tb.lly)
+		}
+		if edges&edgeTop != 0 {
+			hLine(tb.ury)
+		}
+		if edges&edgeLeft != 0 {
+			vLine(tb.llx)
+		}
+		if edges&edgeRight != 0 {
+			vLine(tb.urx)
+		}
+		return b.String()
+	}
+	if edges&edgeBottom != 0 {
+		line(mb.llx-1, tb.lly, bb.llx-gap, tb.lly)
+		line(bb.urx+gap, tb.lly, mb.urx+1, tb.lly)
+	}
+	if edges&edgeTop != 0 {
+		line(mb.llx-1, tb.ury, bb.llx-gap, tb.ury)
+		line(bb.urx+gap, tb.ury, mb.urx+1, tb.ury)
+	}
+	if edges&edgeLeft != 0 {
+		line(tb.llx, mb.ury+1, tb.llx, bb.ury+gap)
+		line(tb.llx, bb.lly-gap, tb.llx, mb.lly-1)
+	}
+	if edges&edgeRight != 0 {
+		line(tb.urx, mb.ury+1, tb.urx, bb.ury+gap)
+		line(tb.urx, bb.lly-gap, tb.urx, mb.lly-1)
+	}
+	return b.String()
+}
+
+// tabEdges returns the edges of the tile which have a glue tab. Only the
+// top and right interior edges have one, so each pair of adjacent tiles
+// is joined by a single tab.
+func tabEdges(p *page) int {
+	return (edgeTop | edgeRight) &^ outerEdges(p)
+}
+
+// tabOutlines returns a PDF path stroking the dashed fold lines and the
+// cut outlines of the glue tabs on the given edges of the tile. Tabs
+// start at the trim line and extend -tab-width beyond the bleed.
+func tabOutlines(p *page, edges int) string {
+	bb, tb := p.bleedBox, p.trimBox
+	tab := tabWidth.pt()
+	// Chamfer the corners so tabs of adjacent edges don't overlap
+	c := (bb.urx - tb.urx + tab) / 2
+	b := &strings.Builder{}
+	if edges&edgeTop != 0 {
+		fmt.Fprintf(b, " q [3 2] 0 d %s %s m %s %s l S Q", pdfNum(tb.llx), pdfNum(tb.ury), pdfNum(tb.urx), pdfNum(tb.ury))
+		fmt.Fprintf(b, " %s %s m %s %s l %s %s l %s %s l S",
+			pdfNum(tb.llx), pdfNum(tb.ury), pdfNum(tb.llx+c), pdfNum(bb.ury+tab), pdfNum(tb.urx-c), pdfNum(bb.ury+tab), pdfNum(tb.urx), pdfNum(tb.ury))
+	}
+	if edges&edgeRight != 0 {
+		fmt.Fprintf(b, " q [3 2] 0 d %s %s m %s %s l S Q", pdfNum(tb.urx), pdfNum(tb.lly), pdfNum(tb.urx), pdfNum(tb.ury))
+		fmt.Fprintf(b, " %s %s m %s %s l %s %s l %s %s l S",
+			pdfNum(tb.urx), pdfNum(tb.ury), pdfNum(bb.urx+tab), pdfNum(tb.ury-c), pdfNum(bb.urx+tab), pdfNum(tb.lly+c), pdfNum(tb.urx), pdfNum(tb.lly))
+	}
+	return b.String()
+}
+
+// clipNudge returns the horizontal offset which moves the block of
+// marks occupying r out of the corner the printer can't print on, as set
+// by -clip-corner.
+func clipNudge(p *page, r rect) float64 {
+	if *clipCorner == "" {
+		return 0
+	}
+	mb := p.mediaBox
+	size := clipSize.pt()
+	zone := rect{mb.llx, mb.lly, mb.llx + size, mb.lly + size}
+	if strings.HasPrefix(*clipCorner, "t") {
+		zone.lly, zone.ury = mb.ury-size, mb.ury
+	}
+	if strings.HasSuffix(*clipCorner, "r") {
+		zone.llx, zone.urx = mb.urx-size, mb.urx
+	}
+	if r.llx >= zone.urx || r.urx <= zone.llx || r.lly >= zone.ury || r.ury <= zone.lly {
+		return 0
+	}
+	if strings.HasSuffix(*clipCorner, "r") {
+		return zone.llx - r.urx
+	}
+	return zone.urx - r.llx
+}
+
+// createOverlayForPage returns a PDF object which contains:
+// - white opaque margin up to bleedMargin
+// - trim marks up to bleedMargin
+// - other printmarks such as tile/page number
 // This will update the contentIds of the page to include a ref
 // to the new overlay object.
 func createOverlayForPage(overlayID int, p *page) string {
 	mb, bb, tb := p.mediaBox, p.bleedBox, p.trimBox
+	// Cover all a viewer may show, should the crop box reach beyond the
+	// media box
+	vb := mb.union(p.cropBox)
 	// Draw opaque bleed margin
-	stream := fmt.Sprintf(` q
-	    1 1 1 rg %f %f m %f %f l %f %f l %f %f l h
-	    %f %f m %f %f l %f %f l %f %f l h f
+	bleed := fmt.Sprintf(` q
+	    1 1 1 rg %s %s m %s %s l %s %s l %s %s l h
+	    %s %s m %s %s l %s %s l %s %s l h f
 	  Q `,
 		// +1s and -1s are to bleed the box outside of viewpoint
-		mb.llx-1, mb.lly-1, mb.llx-1, mb.ury+1, mb.urx+1, mb.ury+1, mb.urx+1, mb.lly-1,
-		bb.llx, bb.lly, bb.urx, bb.lly, bb.urx, bb.ury, bb.llx, bb.ury,
+		pdfNum(vb.llx-1), pdfNum(vb.lly-1), pdfNum(vb.llx-1), pdfNum(vb.ury+1), pdfNum(vb.urx+1), pdfNum(vb.ury+1), pdfNum(vb.urx+1), pdfNum(vb.lly-1),
+		pdfNum(bb.llx), pdfNum(bb.lly), pdfNum(bb.urx), pdfNum(bb.lly), pdfNum(bb.urx), pdfNum(bb.ury), pdfNum(bb.llx), pdfNum(bb.ury),
 	)
-	// Draw trim marks
-
-	if !*longTrimMarks {
-		stream += fmt.Sprintf(` q
-		    0 0 0 rg %f w
-	      %f %f m %f %f l S
-	      %f %f m %f %f l S
-	      %f %f m %f %f l S
-	      %f %f m %f %f l S
-	      %f %f m %f %f l S
-	      %f %f m %f %f l S
-	      %f %f m %f %f l S
-	      %f %f m %f %f l S
-	    Q `,
-			trimMarkLineWidth,
-			mb.llx-1, tb.lly, bb.llx, tb.lly,
-			mb.llx-1, tb.ury, bb.llx, tb.ury,
-			tb.llx, mb.ury+1, tb.llx, bb.ury,
-			tb.urx, mb.ury+1, tb.urx, bb.ury,
-			bb.urx, tb.ury, mb.urx+1, tb.ury,
-			bb.urx, tb.lly, mb.urx+1, tb.lly,
-			tb.llx, bb.lly, tb.llx, mb.lly-1,
-			tb.urx, bb.lly, tb.urx, mb.lly-1,
-		)
-	} else {
-		stream += fmt.Sprintf(` q
-		    0 0 0 rg %f w
-	      %f %f m %f %f l S
-	      %f %f m %f %f l S
-	      %f %f m %f %f l S
-	      %f %f m %f %f l S
-	    Q `,
-			trimMarkLineWidth,
-			mb.llx-1, tb.lly, mb.urx+1, tb.lly, // bottom trim line
-			mb.llx-1, tb.ury, mb.urx+1, tb.ury, // top trim line
-			tb.llx, mb.lly-1, tb.llx, mb.ury+1, // left trim line
-			tb.urx, mb.lly-1, tb.urx, mb.ury+1, // right trim line
+	if *bleedHatch {
+		// Hatch the margin over the fill so the bleed box stands out
+		bleed += fmt.Sprintf(` q
+	    /Pattern cs /%s scn %s %s %s %s re
+	    %s %s m %s %s l %s %s l %s %s l h f*
+	  Q `,
+			hatchPatternName, pdfNum(vb.llx), pdfNum(vb.lly), pdfNum(vb.urx-vb.llx), pdfNum(vb.ury-vb.lly),
+			pdfNum(bb.llx), pdfNum(bb.lly), pdfNum(bb.urx), pdfNum(bb.lly), pdfNum(bb.urx), pdfNum(bb.ury), pdfNum(bb.llx), pdfNum(bb.ury),
 		)
 	}
+	// Draw trim marks, with a white halo to stroke under them if set
+	var stream, halo string
+	lines := func(color, path string) {
+		stream += fmt.Sprintf(" q %s %s w %s Q ", color, pdfNum(trimMarkLineWidth), path)
+		if *markHalo {
+			halo += path
+		}
+	}
+	edges := int(markEdges)
+	if *outerMarksOnly {
+		edges &= outerEdges(p)
+	}
+	if edges != 0 {
+		lines("0 0 0 rg", trimMarks(p, edges))
+	}
+	// Draw registration marks at the corners of every tile or only of
+	// the original page
+	switch *regMarks {
+	case "all":
+		lines("0 0 0 RG", registrationMarks(p, allEdges))
+	case "outer":
+		lines("0 0 0 RG", registrationMarks(p, outerEdges(p)))
+	}
 	// Draw tile ref
-	vch := float32(vecCharHeight)
+	vch := float64(vecCharHeight)
+	row, col := tileRef(p)
+	// Right align long column numbers against the edge of the paper
+	colX, colAlign := bb.urx+vch/2, 1
+	if x := colX + vecCharsWidth(col); x > mb.urx-vch/4 {
+		colX, colAlign = mb.urx-vch/4, -1
+	}
+	tileRefBox := rect{bb.urx - vecCharsWidth(row), bb.ury - vch, bb.urx + vch*2, bb.ury + vch*2}
+	if colAlign < 0 || vch/2+vecCharsWidth(col) > vch*2 {
+		tileRefBox.urx = colX
+		if colAlign > 0 {
+			tileRefBox.urx += vecCharsWidth(col)
+		}
+	}
+	// Arrows pointing from the corner along the row and the column
+	var glyph string
+	if !*noGridGlyph {
+		glyph = fmt.Sprintf(`
+    q
+      0 0 0 rg %s w 2 J
+      %s %s m %s %s l S
+      %s %s m %s %s l S
+      %s %s m %s %s l %s %s l h f
+      %s %s m %s %s l %s %s l h f
+    Q`,
+			pdfNum(trimMarkLineWidth),
+			pdfNum(bb.urx+vch/2), pdfNum(bb.ury+vch/2), pdfNum(bb.urx+vch/2), pdfNum(bb.ury+vch*1.5),
+			pdfNum(bb.urx+vch/2), pdfNum(bb.ury+vch/2), pdfNum(bb.urx+vch*1.5), pdfNum(bb.ury+vch/2),
+			pdfNum(bb.urx+vch/4), pdfNum(bb.ury+vch*1.5), pdfNum(bb.urx+vch*3/4), pdfNum(bb.ury+vch*1.5), pdfNum(bb.urx+vch/2), pdfNum(bb.ury+vch*2),
+			pdfNum(bb.urx+vch*1.5), pdfNum(bb.ury+vch/4), pdfNum(bb.urx+vch*1.5), pdfNum(bb.ury+vch*3/4), pdfNum(bb.urx+vch*2), pdfNum(bb.ury+vch/2),
+		)
+	}
 	stream += fmt.Sprintf(`
+  q 1 0 0 1 %s 0 cm
     q 0 0 0 rg
-      q 1 0 0 1 %f %f cm %s Q
-      q 1 0 0 1 %f %f cm %s Q
-    Q
-    q
-      0 0 0 rg %f w 2 J
-      %f %f m %f %f l S
-      %f %f m %f %f l S
-      %f %f m %f %f l %f %f l h f
-      %f %f m %f %f l %f %f l h f
-    Q
+      q 1 0 0 1 %s %s cm %s Q
+      q 1 0 0 1 %s %s cm %s Q
+    Q%s
+  Q
   `,
-		bb.urx, bb.ury+vch/2, strToVecChars(numToAlpha(p.tileY), -1, 1),
-		bb.urx+vch/2, bb.ury, strToVecChars(strconv.Itoa(p.tileX+1), 1, -1),
-		trimMarkLineWidth,
-		bb.urx+vch/2, bb.ury+vch/2, bb.urx+vch/2, bb.ury+vch*1.5,
-		bb.urx+vch/2, bb.ury+vch/2, bb.urx+vch*1.5, bb.ury+vch/2,
-		bb.urx+vch/4, bb.ury+vch*1.5, bb.urx+vch*3/4, bb.ury+vch*1.5, bb.urx+vch/2, bb.ury+vch*2,
-		bb.urx+vch*1.5, bb.ury+vch/4, bb.urx+vch*1.5, bb.ury+vch*3/4, bb.urx+vch*2, bb.ury+vch/2,
+		pdfNum(clipNudge(p, tileRefBox)),
+		pdfNum(bb.urx), pdfNum(bb.ury+vch/2), strToVecChars(row, -1, 1),
+		pdfNum(colX), pdfNum(bb.ury), strToVecChars(col, colAlign, -1),
+		glyph,
 	)
 	// Draw page ref
-	stream += fmt.Sprintf(` q 0 0 0 rg
-    q 1 0 0 1 %f %f cm %s Q
-    q 1 0 0 1 %f %f cm %s Q
-  Q `,
-		tb.llx-vch/2, bb.ury+vch/2, strToVecChars(strconv.Itoa(p.number), -1, 1),
-		bb.llx-vch/2, bb.ury, strToVecChars("PAGE", -1, -1),
-	)
-	// Draw page title
-	stream += fmt.Sprintf(` q 0 0 0 rg q 1 0 0 1 %f %f cm %s Q Q `,
-		tb.llx+vch/2, bb.lly-vch/2, strToVecChars(*tileTitle, 1, -1),
-	)
+	pageNum := pageRef(p)
+	if *sequentialNumbers {
+		pageNum = strconv.Itoa(p.seq)
+	}
+	if !*noPageRef {
+		pageRefBox := rect{bb.llx - vch/2 - vecCharsWidth("PAGE"), bb.ury - vch, tb.llx - vch/2, bb.ury + vch*1.5}
+		if x := tb.llx - vch/2 - vecCharsWidth(pageNum); x < pageRefBox.llx {
+			pageRefBox.llx = x
+		}
+		stream += fmt.Sprintf(` q 1 0 0 1 %s 0 cm q 0 0 0 rg
+    q 1 0 0 1 %s %s cm %s Q
+    q 1 0 0 1 %s %s cm %s Q
+  Q Q `,
+			pdfNum(clipNudge(p, pageRefBox)),
+			pdfNum(tb.llx-vch/2), pdfNum(bb.ury+vch/2), strToVecChars(pageNum, -1, 1),
+			pdfNum(bb.llx-vch/2), pdfNum(bb.ury), strToVecChars("PAGE", -1, -1),
+		)
+	}
+	if *cutGuides {
+		// Number the interior trim line intersections at the corners of the
+		// tile in reading order
+		for _, c := range []struct {
+			gx, gy int
+			x, y   float64
+			hAlign int
+		}{
+			{p.tileX, p.tileY, bb.llx - vch/4, tb.lly, -1},
+			{p.tileX + 1, p.tileY, bb.urx + vch/4, tb.lly, 1},
+			{p.tileX, p.tileY + 1, bb.llx - vch/4, tb.ury, -1},
+			{p.tileX + 1, p.tileY + 1, bb.urx + vch/4, tb.ury, 1},
+		} {
+			if c.gx <= 0 || c.gx >= p.hTiles || c.gy <= 0 || c.gy >= p.vTiles {
+				continue
+			}
+			if p.flipped {
+				// The corners of the content are at the opposite corners
+				// of the paper
+				c.x, c.y, c.hAlign = bb.llx+bb.urx-c.x, tb.lly+tb.ury-c.y, -c.hAlign
+			}
+			n := (p.vTiles-1-c.gy)*(p.hTiles-1) + c.gx
+			stream += fmt.Sprintf(` q 0 0 0 rg q 1 0 0 1 %s %s cm %s Q Q `,
+				pdfNum(c.x), pdfNum(c.y-vch/4), strToVecChars(strconv.Itoa(n), c.hAlign, -1))
+		}
+	}
+	if *tabs {
+		stream += fmt.Sprintf(" q %s w %s Q ", pdfNum(trimMarkLineWidth), tabOutlines(p, tabEdges(p)))
+	}
+	if *upArrow {
+		// Draw an arrow pointing to the top of the original page, above
+		// the glue tab if there is one
+		cx := (tb.llx + tb.urx) / 2
+		var dy float64
+		if *tabs && tabEdges(p)&edgeTop != 0 {
+			dy = tabWidth.pt()
+		}
+		// Turn the arrow around to point at the top of flipped content
+		flip := "1 0 0 1 0 0"
+		if p.flipped {
+			flip = fmt.Sprintf("-1 0 0 -1 %s %s", pdfNum(cx*2), pdfNum(bb.ury*2+vch*2.5))
+		}
+		stream += fmt.Sprintf(` q 1 0 0 1 0 %s cm %s cm q 0 0 0 rg %s w 2 J
+    %s %s m %s %s l S
+    %s %s m %s %s l %s %s l h f
+    q 1 0 0 1 %s %s cm %s Q
+  Q Q `,
+			pdfNum(dy), flip, pdfNum(trimMarkLineWidth),
+			pdfNum(cx), pdfNum(bb.ury+vch/2), pdfNum(cx), pdfNum(bb.ury+vch*1.5),
+			pdfNum(cx-vch/4), pdfNum(bb.ury+vch*1.5), pdfNum(cx+vch/4), pdfNum(bb.ury+vch*1.5), pdfNum(cx), pdfNum(bb.ury+vch*2),
+			pdfNum(cx+vch/2), pdfNum(bb.ury+vch/2), strToVecChars("TOP", 1, 1),
+		)
+	}
+	// Draw the scale bar at the bottom right, leaving the rest of the
+	// width to the title
+	titleW := tb.urx - tb.llx - vch
+	if scaleBar != 0 {
+		bar, w := scaleBarMarks(p)
+		barBox := rect{tb.urx - vch/2 - w, bb.lly - vch*1.5, tb.urx - vch/2, bb.lly - vch/2}
+		stream += fmt.Sprintf(` q 1 0 0 1 %s 0 cm q 1 0 0 1 %s %s cm %s Q Q `, pdfNum(clipNudge(p, barBox)), pdfNum(barBox.llx), pdfNum(bb.lly-vch), bar)
+		titleW -= w + vch
+	}
+	// Draw the credit at either end of what's left, before the title
+	// takes the rest
+	titleX := tb.llx + vch/2
+	if *credit != "" {
+		c := truncateVecChars(*credit, titleW)
+		w := vecCharsWidth(c)
+		x := titleX
+		if *creditPosition == "bottom-right" {
+			x += titleW - w
+		} else {
+			titleX += w + vch
+		}
+		creditBox := rect{x, bb.lly - vch*1.5, x + w, bb.lly - vch/2}
+		stream += fmt.Sprintf(` q 1 0 0 1 %s 0 cm q 0 0 0 rg q 1 0 0 1 %s %s cm %s Q Q Q `,
+			pdfNum(clipNudge(p, creditBox)), pdfNum(x), pdfNum(bb.lly-vch/2), strToVecChars(c, 1, -1))
+		titleW -= w + vch
+	}
+	// Draw page title, cut short or wrapped to the width of the tile
+	titleLines := []string{truncateVecChars(*tileTitle, titleW)}
+	if *titleWrap {
+		titleLines = wrapVecChars(*tileTitle, titleW, 2)
+	}
+	titleBox := rect{titleX, bb.lly - vch*1.5, titleX, bb.lly - vch/2}
+	var title string
+	for i, l := range titleLines {
+		y := bb.lly - vch/2 - float64(i)*vch*1.5
+		title += fmt.Sprintf(" q 1 0 0 1 %s %s cm %s Q", pdfNum(titleX), pdfNum(y), strToVecChars(l, 1, -1))
+		titleBox.lly = y - vch
+		if x := titleX + vecCharsWidth(l); x > titleBox.urx {
+			titleBox.urx = x
+		}
+	}
+	stream += fmt.Sprintf(` q 1 0 0 1 %s 0 cm q 0 0 0 rg %s Q Q `, pdfNum(clipNudge(p, titleBox)), title)
+	if c, ok := markCaps[*markCap]; ok {
+		// Drop the caps of the arrows so all marks share the one given
+		stream = fmt.Sprintf(" q %d J %s Q ", c, strings.ReplaceAll(stream, " 2 J", ""))
+	}
+	if halo != "" {
+		// Square caps reach past the ends of marks with any cap
+		halo = fmt.Sprintf(" q 1 1 1 RG %s w 2 J %s Q ", pdfNum(trimMarkLineWidth+markHaloWidth*2), halo)
+	}
+	// Set overprinting of the margin and the marks for press
+	withGS := func(name, s string) string {
+		if name == "" || s == "" {
+			return s
+		}
+		return fmt.Sprintf(" q /%s gs %s Q ", name, s)
+	}
+	// The halo knocks out the content under the marks, as white doesn't
+	// show when overprinting
+	switch *bleedOverprint {
+	case "marks":
+		bleed, halo, stream = withGS(knockoutGSName, bleed), withGS(knockoutGSName, halo), withGS(overprintGSName, stream)
+	case "all":
+		bleed, halo, stream = withGS(overprintGSName, bleed), withGS(knockoutGSName, halo), withGS(overprintGSName, stream)
+	}
+	stream = halo + stream
+	// The margin is drawn last if marks are to go under it
+	if *marksUnderBleed {
+		stream += bleed
+	} else {
+		stream = bleed + stream
+	}
+	if *marksAsLayer {
+		stream = fmt.Sprintf(" /OC /%s BDC %s EMC ", marksLayerName, stream)
+	}
 	p.contentIds = append(p.contentIds, overlayID)
-	return fmt.Sprintf("%d 0 obj\n<< /Length %d >> stream\n%sendstream\nendobj\n",
-		overlayID, len(stream), stream)
+	return markStream(overlayID, stream)
+}
+
+// createAssemblyMapForPage returns a new page of w x h pt along
+// with its content stream object, showing how the given tiles of page p
+// are arranged on the original page.
+func createAssemblyMapForPage(mapID int, p *page, tiles []*page, w, h float64) (*page, string) {
+	margin := float64(bleedMargin + trimMargin)
+	vch := float64(vecCharHeight)
+
+	// Scale the original page to fit within the margins
+	tb := p.trimBox
+	scale := (w - margin*2) / (tb.urx - tb.llx)
+	if s := (h - margin*2) / (tb.ury - tb.lly); s < scale {
+		scale = s
+	}
+	offX := (w-(tb.urx-tb.llx)*scale)/2 - tb.llx*scale
+	offY := (h-(tb.ury-tb.lly)*scale)/2 - tb.lly*scale
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, " q 0 0 0 rg q 1 0 0 1 %s %s cm %s Q Q ",
+		pdfNum(margin), pdfNum(h-margin+vch*1.5), strToVecChars("ASSEMBLY MAP PAGE "+pageRef(p), 1, -1))
+	fmt.Fprintf(b, " q 0 0 0 rg q 1 0 0 1 %s %s cm %s Q Q ",
+		pdfNum(margin), pdfNum(margin-vch/2), strToVecChars(*tileTitle, 1, -1))
+	fmt.Fprintf(b, " q 0 0 0 RG %s w", pdfNum(trimMarkLineWidth))
+	for _, t := range tiles {
+		r := t.trimBox
+		fmt.Fprintf(b, " %s %s %s %s re S",
+			pdfNum(r.llx*scale+offX), pdfNum(r.lly*scale+offY), pdfNum((r.urx-r.llx)*scale), pdfNum((r.ury-r.lly)*scale))
+	}
+	fmt.Fprintf(b, " %s w %s %s %s %s re S Q ",
+		pdfNum(trimMarkLineWidth*2), pdfNum(tb.llx*scale+offX), pdfNum(tb.lly*scale+offY), pdfNum((tb.urx-tb.llx)*scale), pdfNum((tb.ury-tb.lly)*scale))
+	for _, t := range tiles {
+		r := t.trimBox
+		fmt.Fprintf(b, " q 0 0 0 rg q 1 0 0 1 %s %s cm %s Q Q ",
+			pdfNum((r.llx+r.urx)/2*scale+offX), pdfNum((r.lly+r.ury)/2*scale+offY),
+			strToVecChars(tileLabel(t), 0, 0))
+	}
+	stream := b.String()
+
+	box := rect{0, 0, w, h}
+	m := &page{
+		name:       "MAP",
+		number:     p.number,
+		mediaBox:   box,
+		cropBox:    box,
+		bleedBox:   box,
+		trimBox:    box,
+		contentIds: []int{mapID},
+		raw:        "  /Resources <<\n  >>\n  /Type /Page",
+	}
+	return m, markStream(mapID, stream)
+}
+
+// createCoverPage returns a new page of w x h pt along with its content
+// stream object, explaining how to print and put together the given
+// tiles of each of the pages.
+func createCoverPage(coverID int, pages []*page, pageTiles [][]*page, opts options, w, h float64) (*page, string) {
+	margin := float64(bleedMargin + trimMargin)
+	vch := float64(vecCharHeight)
+
+	paras := []string{
+		fmt.Sprintf("PRINT ON %s PAPER AT 100 PERCENT SCALE WITH ANY FIT TO PAGE OPTION TURNED OFF. PRINT A SINGLE TILE FIRST AND CHECK ITS SIZE.",
+			strings.ToUpper(opts.size.name)),
+	}
+	for i, p := range pages {
+		t := pageTiles[i][0]
+		if t.asIs {
+			paras = append(paras, fmt.Sprintf("PAGE %s: LEFT AS IS.", pageRef(p)))
+			continue
+		}
+		paras = append(paras, fmt.Sprintf("PAGE %s: %d COLUMNS BY %d ROWS - %d TILES.",
+			pageRef(p), t.hTiles, t.vTiles, len(pageTiles[i])))
+	}
+	// Describe the labels as the overlay draws them and tileIndex counts
+	// them
+	first, up := "BOTTOM", "UP"
+	if strings.HasPrefix(*tileOrigin, "top-") {
+		first, up = "TOP", "DOWN"
+	}
+	from, to := "LEFT", "RIGHT"
+	if strings.HasSuffix(*tileOrigin, "-right") {
+		from, to = "RIGHT", "LEFT"
+	}
+	labels := "EACH TILE SHOWS ITS ROW AND COLUMN AT THE TOP RIGHT."
+	if *sequentialNumbers && !*noPageRef {
+		labels = "EACH TILE SHOWS ITS NUMBER COUNTING ACROSS ALL PAGES AT THE TOP LEFT AND ITS ROW AND COLUMN AT THE TOP RIGHT."
+	} else if !*noPageRef {
+		labels = "EACH TILE SHOWS ITS PAGE NUMBER AT THE TOP LEFT AND ITS ROW AND COLUMN AT THE TOP RIGHT."
+	}
+	paras = append(paras, fmt.Sprintf("%s ROWS ARE LETTERED FROM A AT THE %s AND COLUMNS ARE NUMBERED FROM 1 AT THE %s.",
+		labels, first, from))
+	if opts.overlap > 0 {
+		paras = append(paras, fmt.Sprintf("NEIGHBOURING TILES SHARE AT LEAST %s OF THE PICTURE. CUT THE OUTER EDGES ALONG THE TRIM MARKS. WHERE TILES MEET TRIM ONE OF THE TWO AND GLUE IT OVER THE OTHER.",
+			strings.ToUpper(opts.overlap.String())))
+	} else {
+		paras = append(paras, "CUT EACH TILE ALONG ITS TRIM MARKS AND BUTT THE EDGES OF NEIGHBOURING TILES TOGETHER.")
+	}
+	if opts.tabWidth > 0 {
+		paras = append(paras, "CUT AROUND THE GLUE TABS. FOLD THEM ALONG THE DASHED LINES AND GLUE THEM UNDER THE NEIGHBOURING TILES.")
+	}
+	paras = append(paras, fmt.Sprintf("CUT ORDER: START WITH A1 AT THE %s %s AND WORK ALONG EACH ROW FROM %s TO %s BEFORE MOVING %s TO THE NEXT ROW.",
+		first, from, from, to, up))
+	if *assemblyMap {
+		paras = append(paras, "AN ASSEMBLY MAP BEFORE THE TILES OF EACH PAGE SHOWS WHERE EACH TILE GOES.")
+	}
+
+	b := &strings.Builder{}
+	y := h - margin
+	fmt.Fprintf(b, " q 0 0 0 rg q 1 0 0 1 %s %s cm 2 0 0 2 0 0 cm %s Q Q ",
+		pdfNum(margin), pdfNum(y), strToVecChars("ASSEMBLY INSTRUCTIONS", 1, -1))
+	y -= vch * 3
+	fmt.Fprintf(b, " q 0 0 0 rg q 1 0 0 1 %s %s cm %s Q Q ",
+		pdfNum(margin), pdfNum(y), strToVecChars(truncateVecChars(*tileTitle, w-margin*2), 1, -1))
+	y -= vch * 3
+	for _, para := range paras {
+		for _, l := range wrapVecChars(para, w-margin*2, math.MaxInt32) {
+			if y < margin {
+				break
+			}
+			fmt.Fprintf(b, " q 0 0 0 rg q 1 0 0 1 %s %s cm %s Q Q ", pdfNum(margin), pdfNum(y), strToVecChars(l, 1, -1))
+			y -= vch * 1.5
+		}
+		y -= vch
+	}
+
+	box := rect{0, 0, w, h}
+	c := &page{
+		name:       "INSTRUCTIONS",
+		mediaBox:   box,
+		cropBox:    box,
+		bleedBox:   box,
+		trimBox:    box,
+		contentIds: []int{coverID},
+		raw:        "  /Resources <<\n  >>\n  /Type /Page",
+	}
+	return c, markStream(coverID, b.String())
+}
+
+// parallelize calls fn with 0 to n-1, running up to -jobs calls
+// concurrently.
+func parallelize(n int, fn func(i int)) {
+	if *numJobs <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+	work := make(chan int)
+	wg := sync.WaitGroup{}
+	for j := 0; j < *numJobs && j < n; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+}
+
+// progress reports the number of tiles processed so far on stderr if
+// -progress is set.
+type progress struct {
+	mu    sync.Mutex
+	done  int
+	total int
+}
+
+// add marks n more tiles as processed.
+func (p *progress) add(n int) {
+	if !*showProgress {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += n
+	fmt.Fprintf(os.Stderr, "\rprocessed %d/%d tiles (%d%%)", p.done, p.total, p.done*100/p.total)
+	if p.done == p.total {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// createContactSheetForPage returns a new page the size of a tile
+// showing scaled down tiles of page p along with the objects making up
+// its content, using ids starting from startID. It returns the next free
+// object id. endID is the id of the stream restoring the graphics state
+// of each tile.
+func createContactSheetForPage(startID int, p *page, tiles []*page, endID int, w, h float64) (*page, string, int) {
+	margin := float64(bleedMargin + trimMargin)
+	vch := float64(vecCharHeight)
+	gap := vch * 2
+
+	cols, rows := tiles[0].hTiles, tiles[0].vTiles
+	cellW := (w - margin*2 - gap*float64(cols-1)) / float64(cols)
+	cellH := (h - margin*2 - gap*float64(rows)) / float64(rows)
+
+	b := &strings.Builder{}
+	captions := &strings.Builder{}
+	fmt.Fprintf(captions, " q 0 0 0 rg q 1 0 0 1 %s %s cm %s Q Q ",
+		pdfNum(margin), pdfNum(h-margin+vch*1.5), strToVecChars("CONTACT SHEET PAGE "+pageRef(p), 1, -1))
+	fmt.Fprintf(captions, " q 0 0 0 rg q 1 0 0 1 %s %s cm %s Q Q ",
+		pdfNum(margin), pdfNum(margin-vch/2), strToVecChars(*tileTitle, 1, -1))
+
+	id := startID
+	var contentIds []int
+	for _, t := range tiles {
+		mb := t.mediaBox
+		scale := cellW / (mb.urx - mb.llx)
+		if s := cellH / (mb.ury - mb.lly); s < scale {
+			scale = s
+		}
+		thumbW, thumbH := (mb.urx-mb.llx)*scale, (mb.ury-mb.lly)*scale
+		// Top row holds the top tiles
+		x := margin + float64(t.tileX)*(cellW+gap) + (cellW-thumbW)/2
+		y := margin + gap + float64(rows-1-t.tileY)*(cellH+gap) + (cellH - thumbH)
+		b.WriteString(streamObject(id, fmt.Sprintf("q %s %s %s %s re W n %s 0 0 %s %s %s cm ",
+			pdfNum(x), pdfNum(y), pdfNum(thumbW), pdfNum(thumbH), pdfFactor(scale), pdfFactor(scale), pdfNum(x-mb.llx*scale), pdfNum(y-mb.lly*scale))))
+		contentIds = append(contentIds, id)
+		contentIds = append(contentIds, t.contentIds...)
+		contentIds = append(contentIds, endID)
+		id++
+		fmt.Fprintf(captions, " q 0 0 0 RG %s w %s %s %s %s re S Q ", pdfNum(trimMarkLineWidth), pdfNum(x), pdfNum(y), pdfNum(thumbW), pdfNum(thumbH))
+		fmt.Fprintf(captions, " q 0 0 0 rg q 1 0 0 1 %s %s cm %s Q Q ",
+			pdfNum(x+thumbW/2), pdfNum(y-vch/2), strToVecChars(tileLabel(t), 0, -1))
+	}
+	b.WriteString(markStream(id, captions.String()))
+	contentIds = append(contentIds, id)
+	id++
+
+	box := rect{0, 0, w, h}
+	sheet := &page{
+		name:       "CONTACT SHEET",
+		number:     p.number,
+		mediaBox:   box,
+		cropBox:    box,
+		bleedBox:   box,
+		trimBox:    box,
+		contentIds: contentIds,
+		// Tiles of the page need its resources but annotations would end
+		// up in the wrong place
+		raw: removeDictEntry(p.raw, "Annots"),
+	}
+	return sheet, b.String(), id
+}
+
+// createNUpSheets returns sheets of cols x rows cells of w x h pt, each
+// showing one of the pages placed as a form XObject, along with the
+// objects making them up starting from the given id and the next free id.
+// Pages keep their content streams, with runs of the original content
+// streams of the pages in origPages turned into a form of their own. res
+// holds the resources added to all pages for their overlays.
+func createNUpSheets(d string, id int, pages []*page, origPages []*page, cols, rows int, w, h float64, res string) (string, []*page, int, error) {
+	b := &strings.Builder{}
+
+	// Forms of the original content, keyed by their page number and
+	// content ids, as pages may share content but not resources
+	type contentForm struct {
+		id    int
+		ids   []int
+		page  *page
+		added bool
+	}
+	forms := map[string]*contentForm{}
+	isOrig := map[int]bool{}
+	for _, p := range origPages {
+		key := fmt.Sprint(p.number, p.contentIds)
+		forms[key] = &contentForm{ids: p.contentIds, page: p}
+		for _, cid := range p.contentIds {
+			isOrig[cid] = true
+		}
+	}
+
+	// Turn each page into a form
+	pageForms := make([]int, len(pages))
+	for i, p := range pages {
+		content := &strings.Builder{}
+		xobjects := &strings.Builder{}
+		ids := p.contentIds
+		for j := 0; j < len(ids); {
+			if !isOrig[ids[j]] {
+				data, err := streamData(d, ids[j])
+				if err != nil {
+					return "", nil, 0, err
+				}
+				content.WriteString(data)
+				content.WriteString("\n")
+				j++
+				continue
+			}
+			k := j
+			for k < len(ids) && isOrig[ids[k]] {
+				k++
+			}
+			f, ok := forms[fmt.Sprint(p.number, ids[j:k])]
+			if !ok {
+				return "", nil, 0, fmt.Errorf("cannot find the original page of content %v", ids[j:k])
+			}
+			if !f.added {
+				stream := &strings.Builder{}
+				for _, cid := range f.ids {
+					data, err := streamData(d, cid)
+					if err != nil {
+						return "", nil, 0, fmt.Errorf("can't put content on sheets: %w", err)
+					}
+					stream.WriteString(data)
+					stream.WriteString("\n")
+				}
+				res := strings.TrimPrefix(strings.TrimSpace(getDictEntry(f.page.raw, "Resources")), "/Resources")
+				if res == "" {
+					res = "<< >>"
+				}
+				mb := f.page.mediaBox
+				f.id = id
+				fmt.Fprintf(b, "%d 0 obj\n<< /Type /XObject /Subtype /Form /BBox [ %s %s %s %s ] /Resources %s /Length %d >> stream\n%sendstream\nendobj\n",
+					id, pdfNum(mb.llx), pdfNum(mb.lly), pdfNum(mb.urx), pdfNum(mb.ury), res, stream.Len(), stream.String())
+				f.added = true
+				id++
+			}
+			fmt.Fprintf(content, "q /PdftilecutContent%d Do Q\n", f.id)
+			fmt.Fprintf(xobjects, " /PdftilecutContent%d %d 0 R", f.id, f.id)
+			j = k
+		}
+		mb := p.mediaBox
+		fmt.Fprintf(b, "%d 0 obj\n<< /Type /XObject /Subtype /Form /BBox [ %s %s %s %s ] /Resources << /XObject <<%s >>%s >> /Length %d >> stream\n%sendstream\nendobj\n",
+			id, pdfNum(mb.llx), pdfNum(mb.lly), pdfNum(mb.urx), pdfNum(mb.ury), xobjects.String(), res, content.Len(), content.String())
+		pageForms[i] = id
+		id++
+	}
+
+	// Lay the forms out on the sheets, leaving the rest of the cells of
+	// the last sheet empty
+	var sheets []*page
+	sheetW, sheetH := w*float64(cols), h*float64(rows)
+	for start := 0; start < len(pages); start += cols * rows {
+		content := &strings.Builder{}
+		xobjects := &strings.Builder{}
+		for j := 0; j < cols*rows && start+j < len(pages); j++ {
+			p := pages[start+j]
+			// Rotate clockwise as shown and center within the cell
+			rotate := ((p.rotate%360 + 360) % 360) / 90
+			m := identityMatrix
+			for r := 0; r < rotate; r++ {
+				m = m.mul(matrix{0, -1, 1, 0, 0, 0})
+			}
+			bb := newBBox()
+			bb.addRect(p.mediaBox, m)
+			cx := float64(j%cols)*w + (w-(bb.r.urx-bb.r.llx))/2
+			cy := float64(rows-1-j/cols)*h + (h-(bb.r.ury-bb.r.lly))/2
+			m = m.mul(matrix{1, 0, 0, 1, cx - bb.r.llx, cy - bb.r.lly})
+			fmt.Fprintf(content, "q %s %s %s %s %s %s cm /PdftilecutPage%d Do Q\n",
+				pdfFactor(m[0]), pdfFactor(m[1]), pdfFactor(m[2]), pdfFactor(m[3]), pdfNum(m[4]), pdfNum(m[5]), j)
+			fmt.Fprintf(xobjects, " /PdftilecutPage%d %d 0 R", j, pageForms[start+j])
+		}
+		cuts := &strings.Builder{}
+		fmt.Fprintf(cuts, " q 0 0 0 RG %s w", pdfNum(trimMarkLineWidth))
+		for c := 1; c < cols; c++ {
+			fmt.Fprintf(cuts, " %s 0 m %s %s l S", pdfNum(float64(c)*w), pdfNum(float64(c)*w), pdfNum(sheetH))
+		}
+		for r := 1; r < rows; r++ {
+			fmt.Fprintf(cuts, " 0 %s m %s %s l S", pdfNum(float64(r)*h), pdfNum(sheetW), pdfNum(float64(r)*h))
+		}
+		cuts.WriteString(" Q ")
+		b.WriteString(streamObject(id, content.String()))
+		b.WriteString(markStream(id+1, cuts.String()))
+
+		box := rect{0, 0, sheetW, sheetH}
+		sheets = append(sheets, &page{
+			name:       "SHEET",
+			number:     len(sheets) + 1,
+			mediaBox:   box,
+			cropBox:    box,
+			bleedBox:   box,
+			trimBox:    box,
+			contentIds: []int{id, id + 1},
+			raw:        fmt.Sprintf("  /Resources << /XObject <<%s >> >>\n  /Type /Page", xobjects.String()),
+		})
+		id += 2
+	}
+	return b.String(), sheets, id, nil
+}
+
+// lossyFeatures are the features of the input tiling can't fully keep,
+// found by a pattern in the QDF, each with what happens to it and the
+// -keep-* flag which keeps it, if any.
+var lossyFeatures = []struct {
+	re     *regexp.Regexp
+	effect string
+	keep   *bool
+}{
+	{regexp.MustCompile(`/Annots\b`), "annotations and links are repeated on every tile of their page and may not print", nil},
+	{regexp.MustCompile(`/AcroForm\b`), "form fields refer to the original pages and may stop working", nil},
+	{regexp.MustCompile(`/Outlines\b`), "bookmarks point to the original pages, which are replaced by the tiles", nil},
+	{regexp.MustCompile(`/S\s*/Transparency\b`), "transparency may be flattened differently on each tile when printing", nil},
+	{regexp.MustCompile(`/OCProperties\b`), "layers hidden in the input stay hidden and don't print", nil},
+	{regexp.MustCompile(`/StructTreeRoot\b`), "tags refer to the original pages and are lost - use -keep-tags to keep them", keepTags},
+}
+
+// diagnoseInput logs a summary of the features of the QDF document which
+// tiling will drop or alter.
+func diagnoseInput(data string) {
+	var effects []string
+	for _, f := range lossyFeatures {
+		if (f.keep == nil || !*f.keep) && f.re.MatchString(data) {
+			effects = append(effects, f.effect)
+		}
+	}
+	if len(effects) == 0 {
+		return
+	}
+	log.Print("warning: the input has features tiling can't fully preserve:")
+	for _, e := range effects {
+		log.Printf("  - %s", e)
+	}
 }
 
-func process() error {
+func process(ctx context.Context) error {
 
 	// Convert to QDF form
-	data, err := convertToQDF(*inputFile)
+	data, err := convertToQDF(*inputFile, stdinData)
+	stdinData = nil
 	if err != nil {
 		return err
 	}
+	if *dumpQDF != "" {
+		if err := writeOutput(*dumpQDF, []byte(data)); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if *pdfaMode {
+		// All we can do is preserve what the input has
+		if !strings.Contains(data, "pdfaid:part") {
+			log.Print("warning: input does not declare PDF/A conformance")
+		} else if !strings.Contains(data, "/OutputIntents") {
+			log.Print("warning: input has no output intent")
+		}
+	}
+
+	if *warnLossy {
+		diagnoseInput(data)
+	}
+
+	sizes := tileSizes.sizes
+	if fitPaper.name != "" {
+		// Tile sizes don't apply when fitting onto a single sheet
+		sizes = []tileSizeFlag{fitPaper}
+	}
+	for _, size := range sizes {
+		opts := optionsFromFlags()
+		opts.size = size
+		out, cuts, preview := *outputFile, *cutList, *previewFile
+		if *outDir != "" {
+			out = *outDir
+		}
+		if len(sizes) > 1 {
+			out = sizedName(out, size)
+			if cuts != "" {
+				cuts = sizedName(cuts, size)
+			}
+			if preview != "" {
+				preview = sizedName(preview, size)
+			}
+		}
+		res, err := tileDoc(ctx, data, opts, out, cuts, preview)
+		if err != nil {
+			return err
+		}
+		if *verbose {
+			log.Printf("wrote %s: %d tiles of %d pages, %d bytes, object streams %t, compressed %t",
+				out, res.Tiles, res.Pages, res.Bytes, res.ObjectStreams, res.Compressed)
+		}
+	}
+	return nil
+}
+
+// sizedName returns the file name for the output of the given tile size
+// when there is more than one.
+func sizedName(name string, size tileSizeFlag) string {
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "-" + size.name + ext
+}
+
+// unhashedFlags don't change the output, so -out-hash leaves them out.
+var unhashedFlags = map[string]bool{
+	"in": true, "out": true, "out-hash": true, "debug": true, "jobs": true,
+	"timeout": true, "progress": true, "stdin-memory-limit": true,
+	"dump-qdf": true, "cut-list": true, "output-intent": true,
+	"preview": true, "preview-cell": true, "verbose": true, "summary": true,
+	"verify": true, "warn-lossy": true, "plan": true, "explain": true,
+	"dump-json": true, "jobs-file": true, "selftest": true, "version": true,
+}
+
+// outputHash returns a hash of the input along with the version and the
+// options which make up the output.
+func outputHash() (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "pdftilecut %s\n", getVersion())
+	flag.VisitAll(func(f *flag.Flag) {
+		if !unhashedFlags[f.Name] {
+			fmt.Fprintf(h, "-%s=%s\n", f.Name, f.Value)
+		}
+	})
+	// The profile matters rather than where it's read from
+	h.Write(outputIntentProfile)
+	if stdinData != nil {
+		h.Write(stdinData)
+	} else {
+		f, err := os.Open(*inputFile)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		if _, err := io.Copy(h, f); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// tileResult describes an output written by tileDoc, as summarized by
+// -verbose.
+type tileResult struct {
+	// pages of the input which were tiled
+	Pages int
+	// tiles cut from the pages, whether or not -nup put them on sheets
+	Tiles int
+	// size of the output, and whether QPDF wrote object streams and
+	// compressed streams in it; all zero with -out-dir
+	Bytes         int
+	ObjectStreams bool
+	Compressed    bool
+}
+
+// tileDoc cuts the pages of the QDF document into tiles as set by opts
+// and writes the result to out.
+func tileDoc(ctx context.Context, data string, opts options, out, cuts, preview string) (tileResult, error) {
+	var res tileResult
+	// Get the root page tree object id
+	pageTreeID, err := getPageTreeID(data)
+	if err != nil {
+		return tileResult{}, err
+	}
+
+	nextID, err := getNextFreeObjectID(data)
+	if err != nil {
+		return tileResult{}, err
+	}
+	if *idBase != 0 {
+		if *idBase < nextID {
+			return tileResult{}, fmt.Errorf("-id-base must be more than %d, the largest object id of the input", nextID-1)
+		}
+		nextID = *idBase
+	}
+
+	pages, pageTiles, err := layoutTiles(data, opts)
+	if err != nil {
+		return tileResult{}, err
+	}
+	paperW, paperH := opts.paperSize()
+	var tiles []*page
+	for i, ts := range pageTiles {
+		for _, t := range ts {
+			t.parentID = pageTreeID
+		}
+		// A page cut into a single tile is kept in place with marks added
+		// rather than copied, which keeps links to it and saves an object.
+		// A single tile left of a larger grid by -tiles or -skip-blank is
+		// copied like the others.
+		if len(ts) == 1 && (ts[0].asIs || ts[0].hTiles*ts[0].vTiles == 1) && nup.cols == 0 {
+			ts[0].origID = pages[i].id
+		}
+		tiles = append(tiles, ts...)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return tileResult{}, err
+	}
+
+	startID, endID := nextID, nextID+1
+	{
+		// Wrap page content with graphics state preserving streams
+		var objs string
+		objs, nextID = wrapTileContents(startID, pages, pageTiles)
+		if data, err = insertObjects(data, objs); err != nil {
+			return tileResult{}, err
+		}
+	}
+
+	{
+		// Create overlays and add it to the doc
+		prog := &progress{total: len(tiles)}
+		overlays := make([]string, len(tiles))
+		for i, t := range tiles {
+			t.seq = i + 1
+		}
+		parallelize(len(tiles), func(i int) {
+			if !tiles[i].asIs {
+				overlays[i] = createOverlayForPage(nextID+i, tiles[i])
+			}
+			prog.add(1)
+		})
+		nextID += len(tiles)
+		if data, err = insertObjects(data, strings.Join(overlays, "")); err != nil {
+			return tileResult{}, err
+		}
+	}
+
+	if *assemblyMap && !opts.fitPaper {
+		// Put an assembly map before the tiles of each page
+		b := &strings.Builder{}
+		tiles = nil
+		for i, p := range pages {
+			m, obj := createAssemblyMapForPage(nextID, p, pageTiles[i], paperW, paperH)
+			m.parentID = pageTreeID
+			b.WriteString(obj)
+			nextID++
+			tiles = append(tiles, m)
+			tiles = append(tiles, pageTiles[i]...)
+		}
+		if data, err = insertObjects(data, b.String()); err != nil {
+			return tileResult{}, err
+		}
+	}
+
+	if *contactSheet {
+		// Append a contact sheet of the tiles of each page
+		b := &strings.Builder{}
+		for i, p := range pages {
+			var sheet *page
+			var objs string
+			sheet, objs, nextID = createContactSheetForPage(nextID, p, pageTiles[i], endID, paperW, paperH)
+			sheet.parentID = pageTreeID
+			b.WriteString(objs)
+			tiles = append(tiles, sheet)
+		}
+		if data, err = insertObjects(data, b.String()); err != nil {
+			return tileResult{}, err
+		}
+	}
+
+	if *cover {
+		// Put the instructions before everything else
+		c, obj := createCoverPage(nextID, pages, pageTiles, opts, paperW, paperH)
+		c.parentID = pageTreeID
+		if data, err = insertObjects(data, obj); err != nil {
+			return tileResult{}, err
+		}
+		nextID++
+		tiles = append([]*page{c}, tiles...)
+	}
+
+	// Resources added to all pages for the overlays
+	var overlayRes string
+	if *bleedHatch {
+		// Make the hatch pattern available to the overlays, including those
+		// drawn on contact sheets
+		if data, err = insertObjects(data, createHatchPattern(nextID)); err != nil {
+			return tileResult{}, err
+		}
+		for _, t := range tiles {
+			data = addPageResource(data, t, "Pattern", hatchPatternName, nextID)
+		}
+		overlayRes += fmt.Sprintf(" /Pattern << /%s %d 0 R >>", hatchPatternName, nextID)
+		nextID++
+	}
+	if *bleedOverprint != "knockout" {
+		// Graphics states turning overprinting of the overlays on and off
+		if data, err = insertObjects(data, fmt.Sprintf(
+			"%d 0 obj\n<< /Type /ExtGState /OP true /op true /OPM 1 >>\nendobj\n%d 0 obj\n<< /Type /ExtGState /OP false /op false >>\nendobj\n",
+			nextID, nextID+1)); err != nil {
+			return tileResult{}, err
+		}
+		for _, t := range tiles {
+			data = addPageResource(data, t, "ExtGState", overprintGSName, nextID)
+			data = addPageResource(data, t, "ExtGState", knockoutGSName, nextID+1)
+		}
+		overlayRes += fmt.Sprintf(" /ExtGState << /%s %d 0 R /%s %d 0 R >>", overprintGSName, nextID, knockoutGSName, nextID+1)
+		nextID += 2
+	}
+	if *marksAsLayer {
+		// Put the overlays in a layer viewers can hide
+		if strings.Contains(data, "/OCProperties") {
+			log.Print("warning: replacing the layers of the input with -marks-as-layer")
+		}
+		if data, err = insertObjects(data, fmt.Sprintf("%d 0 obj\n<< /Type /OCG /Name (Trim Marks) >>\nendobj\n", nextID)); err != nil {
+			return tileResult{}, err
+		}
+		for _, t := range tiles {
+			data = addPageResource(data, t, "Properties", marksLayerName, nextID)
+		}
+		if data, err = setCatalogEntry(data, "OCProperties", fmt.Sprintf("<< /OCGs [ %d 0 R ] /D << /Order [ %d 0 R ] /ON [ %d 0 R ] >> >>", nextID, nextID, nextID)); err != nil {
+			return tileResult{}, err
+		}
+		overlayRes += fmt.Sprintf(" /Properties << /%s %d 0 R >>", marksLayerName, nextID)
+		nextID++
+	}
+
+	if nup.cols > 0 {
+		// Put the pages onto sheets instead
+		var objs string
+		objs, tiles, nextID, err = createNUpSheets(data, nextID, tiles, pages, nup.cols, nup.rows, paperW, paperH, overlayRes)
+		if err != nil {
+			return tileResult{}, err
+		}
+		for _, t := range tiles {
+			t.parentID = pageTreeID
+		}
+		if data, err = insertObjects(data, objs); err != nil {
+			return tileResult{}, err
+		}
+	}
+
+	if data, err = appendPagesToDoc(data, nextID, tiles); err != nil {
+		return tileResult{}, err
+	}
+	data = replaceAllDocPagesWith(data, tiles, pageTreeID)
+	nextID += len(tiles)
+
+	if *pageLabels || *pageLabelPrefix != "" {
+		// Label each page in viewers with its tile reference
+		if data, err = insertObjects(data, createPageLabels(nextID, tiles)); err != nil {
+			return tileResult{}, err
+		}
+		if data, err = setCatalogEntry(data, "PageLabels", fmt.Sprintf("%d 0 R", nextID)); err != nil {
+			return tileResult{}, err
+		}
+		nextID++
+	}
+
+	if outputIntentProfile != nil {
+		// Replace any output intents of the input with the profile
+		if strings.Contains(data, "/OutputIntents") {
+			log.Print("warning: replacing the output intents of the input with -output-intent")
+		}
+		if data, err = insertObjects(data, createOutputIntent(nextID, outputIntentProfile)); err != nil {
+			return tileResult{}, err
+		}
+		if data, err = setCatalogEntry(data, "OutputIntents", fmt.Sprintf("[ %d 0 R ]", nextID+1)); err != nil {
+			return tileResult{}, err
+		}
+		nextID += 2
+	}
+
+	if len(tiles) == 0 {
+		return tileResult{}, errors.New("no tiles left to output")
+	}
 
-	// Get the root page tree object id
-	m := regexp.MustCompile(`(?m)^\s+/Pages\s+(\d+)\s+\d+\s+R`).FindStringSubmatch(data)
-	if m == nil {
-		return fmt.Errorf("cannot find root page tree")
+	// Tiles put on sheets are no pages of their own, so refer to the
+	// first sheet instead
+	firstTiles := map[int]int{}
+	for i, p := range pages {
+		firstTiles[p.id] = pageTiles[i][0].id
+		if nup.cols != 0 {
+			firstTiles[p.id] = tiles[0].id
+		}
+	}
+	if *keepTags {
+		// Point the structure tree at the first tile of each page
+		data = remapRefs(data, []string{"Pg"}, firstTiles)
+	}
+	if *resetView {
+		if data, err = setCatalogEntry(data, "PageLayout", "/SinglePage"); err != nil {
+			return tileResult{}, err
+		}
+		if data, err = setCatalogEntry(data, "OpenAction", fmt.Sprintf("[ %d 0 R /Fit ]", tiles[0].id)); err != nil {
+			return tileResult{}, err
+		}
+	} else if data, err = remapOpenAction(data, firstTiles); err != nil {
+		return tileResult{}, err
 	}
-	pageTreeID, _ := strconv.Atoi(m[1])
 
-	nextID, err := getNextFreeObjectID(data)
-	if err != nil {
-		return err
+	if err := ctx.Err(); err != nil {
+		return tileResult{}, err
 	}
 
-	// Convert page size (which includes margins) in mm to
-	// tile sizes (which excludes margins) in pt for use with PDF
-	tileW := (tileSize.width * ptsInInch / mmInInch) - (bleedMargin+trimMargin)*2
-	tileH := (tileSize.height * ptsInInch / mmInInch) - (bleedMargin+trimMargin)*2
+	if err := debugDump("pdftilecut-im2-", data); err != nil {
+		return tileResult{}, err
+	}
 
-	pages := getAllPages(data)
+	if *outDir != "" {
+		if err := writePagesToDir(ctx, data, out, tiles, pageTreeID); err != nil {
+			return tileResult{}, err
+		}
+	} else {
+		// Fix and write back an optimized PDF, unless QPDF would renumber
+		// the objects of -id-base
+		var b []byte
+		if *idBase != 0 {
+			b, err = writeWithXref(data)
+		} else {
+			b, err = convertToOptimizedPDF(data)
+		}
+		if err != nil {
+			return tileResult{}, err
+		}
+		if err := writeOutput(out, b); err != nil {
+			return tileResult{}, err
+		}
+		res.Bytes = len(b)
+		res.ObjectStreams = bytes.Contains(b, []byte("/ObjStm"))
+		res.Compressed = bytes.Contains(b, []byte("/FlateDecode"))
+	}
 
-	// Sort pages by page number if not already sorted
-	sort.Slice(pages, func(i, j int) bool {
-		return pages[i].number < pages[j].number
-	})
+	res.Pages = len(pages)
+	for _, ts := range pageTiles {
+		res.Tiles += len(ts)
+	}
 
-	var tiles []*page
-	for _, p := range pages {
-		ts := cutPageToTiles(p, tileW, tileH, bleedMargin, trimMargin)
-		for _, t := range ts {
-			t.parentID = pageTreeID
+	if cuts != "" {
+		// Only tiles need cutting
+		list := []sheetCutList{}
+		for i, t := range tiles {
+			if t.name == "" {
+				list = append(list, sheetCuts(i+1, t))
+			}
+		}
+		b, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			return tileResult{}, err
+		}
+		if err := writeOutput(cuts, append(b, '\n')); err != nil {
+			return tileResult{}, err
 		}
-		tiles = append(tiles, ts...)
 	}
 
-	{
-		// Wrap page content with graphics state preserving streams
-		objs := fmt.Sprintf(
-			"%d 0 obj\n<< /Length 1 >> stream\nqendstream\nendobj\n%d 0 obj\n<< /Length 1 >> stream\nQendstream\nendobj\n",
-			nextID, nextID+1)
-		data = strings.Replace(data, "\nxref\n", "\n"+objs+"\nxref\n", 1)
-		for _, t := range tiles {
-			t.contentIds = append([]int{nextID}, t.contentIds...)
-			t.contentIds = append(t.contentIds, nextID+1)
+	if preview != "" {
+		if err := writePreview(data, pages, pageTiles, *previewCell, preview); err != nil {
+			return tileResult{}, err
 		}
-		nextID += 2
 	}
 
-	{
-		// Create overlays and add it to the doc
-		b := &strings.Builder{}
-		for _, t := range tiles {
-			b.WriteString(createOverlayForPage(nextID, t))
+	return res, nil
+}
+
+// wrapTileContents wraps the content of the tiles of each page in
+// streams saving and restoring the graphics state, which also place,
+// clip and mirror the content of the page as its tiles need. It returns
+// the stream objects, numbered from startID, and the next free object
+// id. The stream restoring the graphics state is startID+1.
+func wrapTileContents(startID int, pages []*page, pageTiles [][]*page) (string, int) {
+	endID := startID + 1
+	objs := fmt.Sprintf(
+		"%d 0 obj\n<< /Length 1 >> stream\nqendstream\nendobj\n%d 0 obj\n<< /Length 1 >> stream\nQendstream\nendobj\n",
+		startID, endID)
+	nextID := startID + 2
+	for i, p := range pages {
+		// Content outside the crop box of the original page isn't
+		// meant to be seen, so keep it out of the tiles
+		pageStartID, cropClip := startID, ""
+		if p.cropBox != p.mediaBox {
+			c := p.cropBox.intersect(p.mediaBox)
+			cropClip = fmt.Sprintf("%s %s %s %s re W n ", pdfNum(c.llx), pdfNum(c.lly), pdfNum(c.urx-c.llx), pdfNum(c.ury-c.lly))
+		}
+		contentCM := pageTiles[i][0].contentCM
+		if cropClip != "" || contentCM != "" {
+			pageStartID = nextID
+			objs += streamObject(nextID, "q "+contentCM+cropClip)
 			nextID++
 		}
-		data = strings.Replace(data, "\nxref\n", "\n"+b.String()+"\nxref\n", 1)
+		for _, t := range pageTiles[i] {
+			tileStartID := pageStartID
+			if t.flipped {
+				// Turn the content around the center of the trim box
+				tb := t.trimBox
+				tileStartID = nextID
+				objs += streamObject(nextID, fmt.Sprintf("q -1 0 0 -1 %s %s cm ", pdfNum(tb.llx+tb.urx), pdfNum(tb.lly+tb.ury))+contentCM+cropClip)
+				nextID++
+			}
+			content := t.contentIds
+			t.contentIds = append([]int{tileStartID}, content...)
+			t.contentIds = append(t.contentIds, endID)
+			if !*extendBleed || t.asIs {
+				continue
+			}
+			for _, m := range bleedMirrors(t) {
+				objs += streamObject(nextID, m+contentCM+cropClip)
+				t.contentIds = append(t.contentIds, nextID)
+				t.contentIds = append(t.contentIds, content...)
+				t.contentIds = append(t.contentIds, endID)
+				nextID++
+			}
+		}
 	}
+	return objs, nextID
+}
 
-	data = appendPagesToDoc(data, nextID, tiles)
-	data = replaceAllDocPagesWith(data, tiles, pageTreeID)
+// unsafeFileChars are replaced in the parts of file names taken from
+// page references.
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9]+`)
 
-	// Write data back to temp file
-	f, err := ioutil.TempFile("", "pdftilecut-im2-")
-	if err != nil {
+// writePagesToDir writes each of the pages of the QDF document to a PDF
+// of its own in dir, named by its position and reference, along with an
+// index.txt listing them in print order.
+func writePagesToDir(ctx context.Context, d string, dir string, pages []*page, pageTreeID int) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
 		return err
 	}
-	if !*debugMode {
-		defer os.Remove(f.Name())
-	}
-	if _, err := f.Write([]byte(data)); err != nil {
-		f.Close()
-		return err
+	names := make([]string, len(pages))
+	errs := make([]error, len(pages))
+	parallelize(len(pages), func(i int) {
+		if errs[i] = ctx.Err(); errs[i] != nil {
+			return
+		}
+		p := pages[i]
+		ref := fmt.Sprintf("%s-%d", p.name, p.number)
+		if p.name == "" {
+			ref = pageRef(p) + "-" + tileLabel(p)
+		}
+		names[i] = fmt.Sprintf("%03d-%s.pdf", i+1, strings.ToLower(unsafeFileChars.ReplaceAllString(ref, "-")))
+		// Objects only the other pages use are left out
+		b, err := convertToOptimizedPDF(replaceAllDocPagesWith(d, []*page{p}, pageTreeID))
+		if err != nil {
+			errs[i] = err
+			return
+		}
+		errs[i] = writeOutput(filepath.Join(dir, names[i]), b)
+	})
+	index := &strings.Builder{}
+	for i, p := range pages {
+		if errs[i] != nil {
+			return errs[i]
+		}
+		desc := fmt.Sprintf("%s %d", p.name, p.number)
+		if p.name == "" {
+			desc = fmt.Sprintf("PAGE %s TILE %s", pageRef(p), tileLabel(p))
+		}
+		fmt.Fprintf(index, "%s\t%s\n", names[i], desc)
 	}
-	f.Close()
+	return writeOutput(filepath.Join(dir, "index.txt"), []byte(index.String()))
+}
 
-	// Fix and write back an optimized PDF
-	if err := convertToOptimizedPDF(f.Name(), *outputFile); err != nil {
-		return err
+// iccComponents returns the number of color components of the ICC
+// profile, or an error if it's not a valid profile of a color space
+// output intents can use.
+func iccComponents(b []byte) (int, error) {
+	if len(b) < 128 || string(b[36:40]) != "acsp" {
+		return 0, errors.New("not an ICC profile")
 	}
+	if size := binary.BigEndian.Uint32(b); int(size) != len(b) {
+		return 0, fmt.Errorf("ICC profile is %d bytes but declares %d", len(b), size)
+	}
+	switch string(b[16:20]) {
+	case "GRAY":
+		return 1, nil
+	case "RGB ":
+		return 3, nil
+	case "CMYK":
+		return 4, nil
+	}
+	return 0, fmt.Errorf("unsupported ICC profile color space %q", strings.TrimSpace(string(b[16:20])))
+}
 
-	return nil
+// createOutputIntent returns the objects of an output intent with the
+// given ICC profile, the profile stream taking id and the output intent
+// dictionary id+1.
+func createOutputIntent(id int, profile []byte) string {
+	n, _ := iccComponents(profile)
+	subtype := "GTS_PDFX"
+	if *pdfaMode {
+		subtype = "GTS_PDFA1"
+	}
+	name := pdfString(filepath.Base(*outputIntent))
+	return fmt.Sprintf("%d 0 obj\n<< /N %d /Length %d >> stream\n%sendstream\nendobj\n", id, n, len(profile), profile) +
+		fmt.Sprintf("%d 0 obj\n<< /Type /OutputIntent /S /%s /OutputConditionIdentifier %s /Info %s /DestOutputProfile %d 0 R >>\nendobj\n",
+			id+1, subtype, name, name, id)
 }
 
-// convertToOptimizedPDF converts in PDF to a compressed with
+// convertToOptimizedPDF converts the PDF in data to a compressed with
 // object streams PDF using QPDF.
-func convertToOptimizedPDF(in string, out string) error {
+func convertToOptimizedPDF(data string) ([]byte, error) {
 	q, err := qpdf.New()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer q.Close()
 	if !*debugMode {
 		q.SetSuppressWarnings(true)
 	}
-	if err := q.ReadFile(in); err != nil {
-		return err
+	if err := q.ReadMemory("tiled", []byte(data)); err != nil {
+		return nil, err
 	}
 	// TODO enable optimization flags
-	if err := q.InitFileWrite(out); err != nil {
-		return err
+	if err := q.InitWriteMemory(); err != nil {
+		return nil, err
+	}
+	// Outputs named by -out-hash are the same for the same input.
+	// Object ids need no such care as QPDF renumbers all objects in
+	// the order it reaches them from the trailer.
+	q.SetDeterministicID(*outHash || *deterministic)
+	// PDF/A requires the info dictionary to match the XMP metadata
+	if !*pdfaMode {
+		q.SetInfoKey("/Producer", "pdftilecut "+getVersion())
+	}
+	if *pdfaMode {
+		// PDF/A-1 does not allow object streams
+		q.SetObjectStreamMode(qpdf.ObjectStreamDisable)
+	} else {
+		q.SetObjectStreamMode(qpdf.ObjectStreamGenerate)
 	}
-	q.SetObjectStreamMode(qpdf.ObjectStreamGenerate)
 	q.SetStreamDataMode(qpdf.StreamDataPreserve)
-	q.SetCompressStreams(true)
+	q.SetCompressStreams(*streamFilter != "none")
+	if *streamFilter != "preserve" {
+		// Images keep their specialized filters such as DCT
+		q.SetDecodeLevel(qpdf.DecodeLevelGeneralized)
+	}
+	q.SetContentNormalization(*normalizeContent)
 	if err := q.Write(); err != nil {
+		return nil, err
+	}
+	return q.GetBuffer(), nil
+}
+
+var (
+	objHeaderRe = regexp.MustCompile(`(?m)^(\d+) (\d+) obj\b`)
+	// end of the dictionary of a stream, or of an object without one
+	streamOrEndRe = regexp.MustCompile(`\bstream\r?\n|\bendobj\b`)
+	lengthRe      = regexp.MustCompile(`/Length\s+(\d+)(\s+\d+\s+R)?`)
+	trailerSizeRe = regexp.MustCompile(`/Size\s+\d+`)
+)
+
+// writeWithXref returns the QDF document as it is with a cross-reference
+// table rebuilt for it, so its objects keep their ids rather than being
+// renumbered by QPDF. Unused ids are listed as free for reuse.
+func writeWithXref(data string) ([]byte, error) {
+	end := strings.LastIndex(data, "\nxref\n")
+	if end < 0 {
+		return nil, errors.New("cannot find the xref section at the end of the document")
+	}
+	t, s := strings.Index(data[end:], "trailer"), strings.Index(data[end:], "startxref")
+	if t < 0 || s < t {
+		return nil, errors.New("cannot find the trailer at the end of the document")
+	}
+	body, trailer := data[:end+1], data[end+t:end+s]
+
+	type entry struct{ offset, gen int }
+	objs := map[int]entry{}
+	maxID := 0
+	for pos := 0; ; {
+		loc := objHeaderRe.FindStringSubmatchIndex(body[pos:])
+		if loc == nil {
+			break
+		}
+		id, _ := strconv.Atoi(body[pos+loc[2] : pos+loc[3]])
+		gen, _ := strconv.Atoi(body[pos+loc[4] : pos+loc[5]])
+		objs[id] = entry{pos + loc[0], gen}
+		if id > maxID {
+			maxID = id
+		}
+		pos += loc[1]
+		m := streamOrEndRe.FindStringIndex(body[pos:])
+		if m == nil {
+			return nil, fmt.Errorf("cannot find the end of object %d", id)
+		}
+		if body[pos+m[0]] == 'e' {
+			pos += m[1]
+			continue
+		}
+		// Skip the data of streams, which may look like anything
+		l := lengthRe.FindStringSubmatch(body[pos : pos+m[0]])
+		if l == nil {
+			return nil, fmt.Errorf("cannot find the length of stream object %d", id)
+		}
+		n, _ := strconv.Atoi(l[1])
+		if l[2] != "" {
+			v := regexp.MustCompile(fmt.Sprintf(`(?m)^%d 0 obj\s+(\d+)\s+endobj`, n)).FindStringSubmatch(body)
+			if v == nil {
+				return nil, fmt.Errorf("cannot find the length of stream object %d", id)
+			}
+			n, _ = strconv.Atoi(v[1])
+		}
+		pos += m[1] + n
+	}
+
+	// Free ids are linked from the entry of id 0
+	var free []int
+	for id := 1; id <= maxID; id++ {
+		if _, ok := objs[id]; !ok {
+			free = append(free, id)
+		}
+	}
+	free = append(free, 0)
+	b := &bytes.Buffer{}
+	b.WriteString(body)
+	xref := b.Len()
+	fmt.Fprintf(b, "xref\n0 %d\n%010d 65535 f \n", maxID+1, free[0])
+	for id, f := 1, 1; id <= maxID; id++ {
+		if e, ok := objs[id]; ok {
+			fmt.Fprintf(b, "%010d %05d n \n", e.offset, e.gen)
+		} else {
+			fmt.Fprintf(b, "%010d 00000 f \n", free[f])
+			f++
+		}
+	}
+	b.WriteString(trailerSizeRe.ReplaceAllLiteralString(trailer, fmt.Sprintf("/Size %d", maxID+1)))
+	fmt.Fprintf(b, "startxref\n%d\n%%%%EOF\n", xref)
+	return b.Bytes(), nil
+}
+
+// writeOutput writes b to the named file, or stdout if name is "-".
+func writeOutput(name string, b []byte) error {
+	if name == "-" {
+		_, err := os.Stdout.Write(b)
 		return err
 	}
-	return nil
+	outputsWrittenMu.Lock()
+	outputsWritten = append(outputsWritten, name)
+	outputsWrittenMu.Unlock()
+	return ioutil.WriteFile(name, b, 0666)
+}
+
+// isPDF reports whether the given file starts with a PDF header. As
+// with most readers, the header may be preceded by up to 1KB of junk.
+func isPDF(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	b := make([]byte, 1024)
+	n, err := io.ReadFull(f, b)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	return hasPDFHeader(b[:n]), nil
+}
+
+// hasPDFHeader returns true if the PDF header is within the first 1KB
+// of b.
+func hasPDFHeader(b []byte) bool {
+	if len(b) > 1024 {
+		b = b[:1024]
+	}
+	return bytes.Contains(b, []byte("%PDF-"))
 }
 
 // convertToQDF uses QPDF to convert an input PDF to a normalized
-// format that is easy to parse and manipulate.
-func convertToQDF(in string) (string, error) {
+// format that is easy to parse and manipulate. If buf is not nil, the
+// input is read from it instead of the named file.
+func convertToQDF(in string, buf []byte) (string, error) {
+	var ok bool
+	var err error
+	if buf != nil {
+		ok = hasPDFHeader(buf)
+	} else if ok, err = isPDF(in); err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", errors.New("input is not a PDF file")
+	}
 	q, err := qpdf.New()
 	if err != nil {
 		return "", err
@@ -582,18 +3553,24 @@ func convertToQDF(in string) (string, error) {
 	if !*debugMode {
 		q.SetSuppressWarnings(true)
 	}
-	if err := q.ReadFile(in); err != nil {
+	if buf != nil {
+		err = q.ReadMemory(in, buf)
+	} else {
+		err = q.ReadFile(in)
+	}
+	if err != nil {
 		return "", err
 	}
-	f, err := ioutil.TempFile("", "pdftilecut-im-")
+	numPages, err := q.NumberOfPages()
 	if err != nil {
-		return "", nil
+		return "", err
 	}
-	f.Close()
-	if !*debugMode {
-		defer os.Remove(f.Name())
+	if titleFromInfo {
+		if t := strings.TrimSpace(q.GetInfoKey("/Title")); t != "" {
+			*tileTitle = strings.ToUpper(t)
+		}
 	}
-	if err := q.InitFileWrite(f.Name()); err != nil {
+	if err := q.InitWriteMemory(); err != nil {
 		return "", err
 	}
 	q.SetQDFMode(true)
@@ -602,18 +3579,129 @@ func convertToQDF(in string) (string, error) {
 	if err := q.Write(); err != nil {
 		return "", err
 	}
+	data := string(q.GetBuffer())
 	q.Close() // free up memory as soon as possible
+	if err := checkPagesFound(data, numPages); err != nil {
+		return "", err
+	}
+	if data, err = flattenPageTree(data); err != nil {
+		return "", err
+	}
+	if err := debugDump("pdftilecut-im-", data); err != nil {
+		return "", err
+	}
+	return data, nil
+}
+
+// checkPagesFound returns an error if none of the numPages pages QPDF
+// counted in the document are found in its QDF form data, which would
+// silently leave the output empty.
+func checkPagesFound(data string, numPages int) error {
+	if numPages > 0 && !pageObjRe.MatchString(data) {
+		return fmt.Errorf("input has %d pages but none were found in its QDF form - please report this with the output of -dump-qdf", numPages)
+	}
+	return nil
+}
 
-	f, err = os.Open(f.Name())
+// debugDump writes data to a new file in the temp directory in debug
+// mode, to inspect intermediate documents.
+func debugDump(prefix, data string) error {
+	if !*debugMode {
+		return nil
+	}
+	f, err := ioutil.TempFile(tempDir, prefix)
 	if err != nil {
-		return "", err
+		return err
 	}
 	defer f.Close()
-	b, err := ioutil.ReadAll(f)
+	_, err = f.WriteString(data)
+	return err
+}
+
+// dumpObject is an object of the document as written by -dump-json.
+type dumpObject struct {
+	ID     int    `json:"id"`
+	Value  string `json:"value"`
+	Stream int    `json:"streamLength,omitempty"`
+}
+
+// dumpPage is a page of the document as written by -dump-json, along
+// with the error from extracting its attributes, if any.
+type dumpPage struct {
+	Number int    `json:"number"`
+	ID     int    `json:"id"`
+	Error  string `json:"error,omitempty"`
+}
+
+// dumpJSON writes the objects and pages of the QDF document to w as
+// JSON. It's meant for debugging the parsing of unusual inputs and the
+// format is not stable. Stream data is left out.
+func dumpJSON(w io.Writer, d string) error {
+	var dump struct {
+		Pages   []dumpPage   `json:"pages"`
+		Objects []dumpObject `json:"objects"`
+	}
+	for _, pm := range pageObjRe.FindAllStringSubmatch(d, -1) {
+		pNum, _ := strconv.Atoi(pm[1])
+		pID, _ := strconv.Atoi(pm[2])
+		p := page{id: pID, number: pNum, raw: pm[3]}
+		dp := dumpPage{Number: pNum, ID: pID}
+		if err := p.extractAttrs(); err != nil {
+			dp.Error = err.Error()
+		}
+		dump.Pages = append(dump.Pages, dp)
+	}
+	objRe := regexp.MustCompile(`(?ms)^(\d+)\s+\d+\s+obj\n(.*?)\n^endobj`)
+	for _, om := range objRe.FindAllStringSubmatch(d, -1) {
+		id, _ := strconv.Atoi(om[1])
+		o := dumpObject{ID: id, Value: om[2]}
+		if i := strings.Index(o.Value, "\nstream\n"); i >= 0 {
+			o.Stream = len(strings.TrimSuffix(o.Value[i+8:], "\nendstream"))
+			o.Value = o.Value[:i]
+		}
+		dump.Objects = append(dump.Objects, o)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(dump)
+}
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = ""
+
+// getVersion returns the version of pdftilecut, falling back to the
+// module version when not set at build time.
+func getVersion() string {
+	if version != "" {
+		return version
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" {
+		return bi.Main.Version
+	}
+	return "(devel)"
+}
+
+// printVersion prints the versions of pdftilecut, QPDF and the build.
+func printVersion() error {
+	q, err := qpdf.New()
 	if err != nil {
-		return "", err
+		return err
+	}
+	defer q.Close()
+	fmt.Printf("pdftilecut %s\n", getVersion())
+	fmt.Printf("qpdf %s\n", q.QPDFVersion())
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		fmt.Printf("built with %s", bi.GoVersion)
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision", "vcs.time", "vcs.modified":
+				fmt.Printf(" %s=%s", s.Key, s.Value)
+			}
+		}
+		fmt.Println()
 	}
-	return string(b), nil
+	return nil
 }
 
 func main() {
@@ -625,20 +3713,234 @@ func main() {
 func run() error {
 	flag.Parse()
 
-	// Create temp file for input and output if needed
-	if *inputFile == "-" {
-		f, err := ioutil.TempFile("", "pdftilecut-in-")
+	if *showVersion {
+		return printVersion()
+	}
+
+	// Jobs are run with the options of the command line, before the
+	// environment and presets apply
+	if *jobsFile != "" {
+		return runJobsFile(*jobsFile)
+	}
+
+	// The self test checks the defaults
+	if *selfTest && flag.NFlag() > 1 {
+		return errors.New("-selftest can't be used with other options")
+	}
+
+	if *preset != "" {
+		defaults, ok := presets[*preset]
+		if !ok {
+			return errors.New("-preset must be one of home-poster, print-shop or signage")
+		}
+		if err := setDefaultFlags(defaults); err != nil {
+			return err
+		}
+	}
+	poster := *posterMode
+	if poster {
+		if err := setDefaultFlags(posterDefaults); err != nil {
+			return err
+		}
+	}
+	// The environment only fills in what the command line, -preset and
+	// -poster leave unset, and may turn on -poster itself
+	if !*selfTest {
+		if err := setEnvFlags(); err != nil {
+			return err
+		}
+	}
+	if *posterMode && !poster {
+		if err := setDefaultFlags(posterDefaults); err != nil {
+			return err
+		}
+	}
+	if *stdinMemoryLimit < 0 {
+		return errors.New("-stdin-memory-limit must not be negative")
+	}
+	if *numJobs < 1 {
+		return errors.New("-jobs must be at least 1")
+	}
+	if *startNumber < 1 {
+		return errors.New("-start-number must be at least 1")
+	}
+	if *outputRotate%90 != 0 {
+		return errors.New("-output-rotate must be a multiple of 90")
+	}
+	if m := printer.bleedMargins(); markGap.pt() >= m.top || markGap.pt() >= m.right ||
+		markGap.pt() >= m.bottom || markGap.pt() >= m.left {
+		return errors.New("-mark-gap must be smaller than the margin outside the bleed box")
+	}
+	switch *tileOrientation {
+	case "auto", "portrait", "landscape":
+	default:
+		return errors.New("-tile-orientation must be one of auto, portrait or landscape")
+	}
+	switch *clipCorner {
+	case "", "tl", "tr", "bl", "br":
+	default:
+		return errors.New("-clip-corner must be one of tl, tr, bl or br")
+	}
+	switch *bleedOverprint {
+	case "knockout", "marks", "all":
+	default:
+		return errors.New("-bleed-overprint must be one of knockout, marks or all")
+	}
+	switch *tileOrigin {
+	case "bottom-left", "top-left", "top-right", "bottom-right":
+	default:
+		return errors.New("-origin must be one of bottom-left, top-left, top-right or bottom-right")
+	}
+	switch *creditPosition {
+	case "bottom-left", "bottom-right":
+	default:
+		return errors.New("-credit-position must be one of bottom-left or bottom-right")
+	}
+	switch *regMarks {
+	case "", "all", "outer":
+	default:
+		return errors.New("-registration-marks must be one of all or outer")
+	}
+	if _, ok := markCaps[*markCap]; !ok && *markCap != "" {
+		return errors.New("-mark-cap must be one of butt, round or square")
+	}
+	switch *streamFilter {
+	case "preserve", "flate", "none":
+	default:
+		return errors.New("-stream-filter must be one of preserve, flate or none")
+	}
+	if *idBase < 0 {
+		return errors.New("-id-base must not be negative")
+	}
+	if *idBase != 0 && (*outDir != "" || *pdfaMode || *deterministic || *outHash || *normalizeContent || *streamFilter != "preserve") {
+		return errors.New("-id-base can't be used with -out-dir, -pdfa, -deterministic, -out-hash, -normalize-content or -stream-filter")
+	}
+	switch *parity {
+	case "", "odd", "even":
+	default:
+		return errors.New("-parity must be one of odd or even")
+	}
+	switch *brick {
+	case "", "rows", "checkerboard":
+	default:
+		return errors.New("-brick must be one of rows or checkerboard")
+	}
+	if *fillTile && fitPaper.name != "" {
+		return errors.New("-fill-tile can't be used with -fit-paper")
+	}
+	if *brick != "" && (*tabs || *extendBleed) {
+		return errors.New("-brick can't be used with -tabs or -extend-bleed")
+	}
+	if *padGrid && (fitPaper.name != "" || *skipBlank || *onlyTiles != "") {
+		return errors.New("-pad-grid can't be used with -fit-paper, -skip-blank or -tiles")
+	}
+	if *maxAspect != 0 && *maxAspect < 1 {
+		return errors.New("-max-aspect must be at least 1")
+	}
+	if *centerContent && !*padGrid {
+		return errors.New("-center-content can only be used with -pad-grid")
+	}
+
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	// Keep all temp files in one directory so they can be cleaned up
+	// even when processing is abandoned
+	var err error
+	tempDir, err = ioutil.TempDir("", "pdftilecut-")
+	if err != nil {
+		return err
+	}
+	if !*debugMode {
+		defer os.RemoveAll(tempDir)
+	}
+
+	if *selfTest {
+		return runSelfTest(ctx)
+	}
+
+	if *explain {
+		opts := optionsFromFlags()
+		if opts.fitPaper {
+			return explainTiles(os.Stdout, opts)
+		}
+		for _, size := range tileSizes.sizes {
+			opts.size = size
+			if err := explainTiles(os.Stdout, opts); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if *planMode {
+		var in io.Reader = os.Stdin
+		if *inputFile != "-" {
+			f, err := os.Open(*inputFile)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+		plans, err := planTiles(in, optionsFromFlags())
 		if err != nil {
 			return err
 		}
-		defer os.Remove(f.Name())
-		if _, err := io.Copy(f, os.Stdin); err != nil {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plans)
+	}
+
+	if *outputIntent != "" {
+		b, err := ioutil.ReadFile(*outputIntent)
+		if err != nil {
 			return err
 		}
-		if err := f.Close(); err != nil {
+		if _, err := iccComponents(b); err != nil {
+			return fmt.Errorf("invalid -output-intent: %w", err)
+		}
+		outputIntentProfile = b
+	}
+
+	// The file name is still the fallback when the input has no title
+	titleFromInfo = *titleFromMeta && *tileTitle == ""
+	if u := undrawableVecChars(strings.ToUpper(*tileTitle)); u != "" {
+		log.Printf("warning: -title has characters which can't be drawn and are left blank: %s", u)
+	}
+	*credit = strings.ToUpper(*credit)
+	if u := undrawableVecChars(*credit); u != "" {
+		log.Printf("warning: -credit has characters which can't be drawn and are left blank: %s", u)
+	}
+
+	// Keep small stdin input in memory and spill the rest to a temp file
+	if *inputFile == "-" {
+		limit := int64(*stdinMemoryLimit) << 20
+		buf, err := ioutil.ReadAll(io.LimitReader(os.Stdin, limit+1))
+		if err != nil {
 			return err
 		}
-		*inputFile = f.Name()
+		if int64(len(buf)) <= limit {
+			stdinData = buf
+			*inputFile = stdinName
+		} else {
+			f, err := ioutil.TempFile(tempDir, "pdftilecut-in-")
+			if err != nil {
+				return err
+			}
+			defer os.Remove(f.Name())
+			if _, err := io.Copy(f, io.MultiReader(bytes.NewReader(buf), os.Stdin)); err != nil {
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+			*inputFile = f.Name()
+		}
 		if *tileTitle == "" {
 			*tileTitle = "stdin"
 		}
@@ -647,34 +3949,77 @@ func run() error {
 	}
 	*tileTitle = strings.ToUpper(*tileTitle)
 
-	var toStdout bool
-
-	if *outputFile == "-" {
-		f, err := ioutil.TempFile("", "pdftilecut-out-")
+	if *dumpJSONMode {
+		data, err := convertToQDF(*inputFile, stdinData)
 		if err != nil {
 			return err
 		}
-		f.Close()
-		defer os.Remove(f.Name())
-		*outputFile = f.Name()
-		toStdout = true
+		return dumpJSON(os.Stdout, data)
 	}
 
-	// Tile cut
-	if err := process(); err != nil {
-		return err
+	if nup.cols > 0 && (*keepTags || *cutList != "") {
+		return errors.New("-nup can't be used with -keep-tags or -cut-list")
+	}
+	if *outDir != "" && (*outputFile != "-" || *outHash || *keepTags) {
+		return errors.New("-out-dir can't be used with -out, -out-hash or -keep-tags")
+	}
+	if *outputFile == "-" && *outDir == "" && *cutList == "-" {
+		return errors.New("-out and -cut-list can't both be stdout")
+	}
+	if *outputFile == "-" && *outDir == "" && *previewFile == "-" {
+		return errors.New("-out and -preview can't both be stdout")
+	}
+	if *previewCell < 8 {
+		return errors.New("-preview-cell must be at least 8")
+	}
+	if *outputFile == "-" && *outDir == "" && *dumpQDF == "-" {
+		return errors.New("-out and -dump-qdf can't both be stdout")
+	}
+	if *outputFile == "-" && *outDir == "" && len(tileSizes.sizes) > 1 && fitPaper.name == "" {
+		return errors.New("-out must be given with more than one -tile-size")
 	}
 
-	// Cleanup
-	if toStdout {
-		f, err := os.Open(*outputFile)
+	if *outHash {
+		if *outputFile == "-" {
+			return errors.New("-out must be given with -out-hash")
+		}
+		hash, err := outputHash()
 		if err != nil {
 			return err
 		}
-		defer f.Close()
-		if _, err := io.Copy(os.Stdout, f); err != nil {
-			return err
+		*outputFile = filepath.Join(filepath.Dir(*outputFile), hash+filepath.Ext(*outputFile))
+		names := []string{*outputFile}
+		if len(tileSizes.sizes) > 1 && fitPaper.name == "" {
+			names = nil
+			for _, size := range tileSizes.sizes {
+				names = append(names, sizedName(*outputFile, size))
+			}
+		}
+		// Let the caller know where to find the output, tiled or not
+		done := true
+		for _, name := range names {
+			fmt.Println(name)
+			if _, err := os.Stat(name); err != nil {
+				done = false
+			}
+		}
+		if done {
+			log.Print("output already exists, skipping")
+			return nil
+		}
+	}
+
+	// Tile cut, which stops at the next check of ctx once it times out
+	// so its temp files aren't removed while still being written
+	err = process(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		for _, name := range outputsWritten {
+			os.Remove(name)
 		}
+		return fmt.Errorf("processing timed out after %s", *timeout)
+	}
+	if err != nil {
+		return err
 	}
 
 	return nil
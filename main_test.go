@@ -0,0 +1,986 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testQDF returns a document laid out like the QDF written by qpdf with
+// objs as its objects, numbered from 1. Objects of /Type /Page are
+// preceded by the comment with their page number.
+func testQDF(objs ...string) string {
+	b := &strings.Builder{}
+	b.WriteString("%PDF-1.3\n%QDF-1.0\n\n")
+	n := 0
+	for i, o := range objs {
+		if strings.Contains(o, "/Type /Page\n") {
+			n++
+			fmt.Fprintf(b, "%%%% Page %d\n", n)
+		}
+		fmt.Fprintf(b, "%%%% Original object ID: %d 0\n%d 0 obj\n%s\nendobj\n\n", i+1, i+1, o)
+	}
+	fmt.Fprintf(b, "xref\n0 %d\n0000000000 65535 f \ntrailer <<\n  /Root 1 0 R\n  /Size %d\n>>\nstartxref\n0\n%%%%EOF\n",
+		len(objs)+1, len(objs)+1)
+	return b.String()
+}
+
+// testDict returns a dictionary of a QDF with the given entries.
+func testDict(entries ...string) string {
+	return "<<\n  " + strings.Join(entries, "\n  ") + "\n>>"
+}
+
+// testStream returns the content of stream object id of objs.
+func testStream(t *testing.T, objs string, id int) string {
+	t.Helper()
+	m := regexp.MustCompile(fmt.Sprintf(`(?ms)^%d 0 obj\n<< /Length \d+ >> stream\n(.*?)endstream`, id)).FindStringSubmatch(objs)
+	if m == nil {
+		t.Fatalf("no stream object %d in:\n%s", id, objs)
+	}
+	return m[1]
+}
+
+func TestExtractAttrs(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		mediaBox rect
+		trimBox  rect
+		rotate   int
+		contents []int
+		rest     string
+	}{
+		{
+			name:     "qdf",
+			raw:      "  /Contents 4 0 R\n  /MediaBox [\n    0\n    0\n    612\n    792\n  ]\n  /Parent 2 0 R\n  /Type /Page",
+			mediaBox: rect{0, 0, 612, 792},
+			trimBox:  rect{0, 0, 612, 792},
+			contents: []int{4},
+			rest:     "  /Type /Page",
+		},
+		{
+			name:     "tabs and spaces",
+			raw:      "\t/MediaBox\t[ 0  0\t612.5 792 ]\n\t/TrimBox   [10 10 602.5 782]\n/Rotate   90\n\t/Contents [ 4 0 R  5 0 R ]\n\t/Type /Page",
+			mediaBox: rect{0, 0, 612.5, 792},
+			trimBox:  rect{10, 10, 602.5, 782},
+			rotate:   90,
+			contents: []int{4, 5},
+			rest:     "\t/Type /Page",
+		},
+		{
+			name:     "not at line start",
+			raw:      "/Type /Page /MediaBox [0 0 100 200] /Contents 7 0 R /Rotate -90 /Parent 2 0 R",
+			mediaBox: rect{0, 0, 100, 200},
+			trimBox:  rect{0, 0, 100, 200},
+			rotate:   -90,
+			contents: []int{7},
+			rest:     "/Type /Page ",
+		},
+		{
+			name:     "keys of nested dictionaries",
+			raw:      "  /Annots [ << /Subtype /Text /Rect [ 0 0 1 1 ] /Contents (x /Rotate 5 >>) /Parent 3 0 R /Rotate 90 >> ]\n  /Contents 4 0 R\n  /Group << /S /Transparency /CropBox [ 0 0 1 1 ] >>\n  /MediaBox [ 0 0 612 792 ]",
+			mediaBox: rect{0, 0, 612, 792},
+			trimBox:  rect{0, 0, 612, 792},
+			contents: []int{4},
+			rest:     "  /Annots [ << /Subtype /Text /Rect [ 0 0 1 1 ] /Contents (x /Rotate 5 >>) /Parent 3 0 R /Rotate 90 >> ]\n  /Group << /S /Transparency /CropBox [ 0 0 1 1 ] >>\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &page{raw: tt.raw}
+			if err := p.extractAttrs(); err != nil {
+				t.Fatal(err)
+			}
+			if p.mediaBox != tt.mediaBox {
+				t.Errorf("mediaBox = %v, want %v", p.mediaBox, tt.mediaBox)
+			}
+			if p.trimBox != tt.trimBox {
+				t.Errorf("trimBox = %v, want %v", p.trimBox, tt.trimBox)
+			}
+			if p.rotate != tt.rotate {
+				t.Errorf("rotate = %d, want %d", p.rotate, tt.rotate)
+			}
+			if !reflect.DeepEqual(p.contentIds, tt.contents) {
+				t.Errorf("contentIds = %v, want %v", p.contentIds, tt.contents)
+			}
+			if p.raw != tt.rest {
+				t.Errorf("raw = %q, want %q", p.raw, tt.rest)
+			}
+		})
+	}
+}
+
+func TestTopLevel(t *testing.T) {
+	tests := []struct {
+		raw, want string
+	}{
+		{"/A 1 /B [ 2 ]", "/A 1 /B [ 2 ]"},
+		{"/A << /B 1 >> /C 2", "/A            /C 2"},
+		{"/A << /B << /C 1 >> >>\n/D 2", "/A                    \n/D 2"},
+		{"/A (x \\) >> /B) /C <41> /D 1", "/A              /C      /D 1"},
+	}
+	for _, tt := range tests {
+		if got := topLevel(tt.raw); got != tt.want {
+			t.Errorf("topLevel(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestWrapTileContentsCropBox(t *testing.T) {
+	tests := []struct {
+		name    string
+		cropBox string
+		start   string
+		trimBox rect
+	}{
+		{"no crop box", "", "q", rect{0, 0, 600, 800}},
+		{"inset", "/CropBox [ 50 100 550 700 ]", "q 50 100 500 600 re W n ", rect{50, 100, 550, 700}},
+		{"beyond the media box", "/CropBox [ -50 -50 700 700 ]", "q 0 0 600 700 re W n ", rect{-50, -50, 700, 700}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := testQDF(
+				testDict("/Pages 2 0 R", "/Type /Catalog"),
+				testDict("/Count 1", "/Kids [ 3 0 R ]", "/Type /Pages"),
+				testDict("/Contents 4 0 R", tt.cropBox, "/MediaBox [ 0 0 600 800 ]", "/Parent 2 0 R", "/Type /Page"),
+				testDict("/Length 0"),
+			)
+			pages := getAllPages(d)
+			if len(pages) != 1 {
+				t.Fatalf("got %d pages, want 1", len(pages))
+			}
+			ts, err := cutPageToTiles(pages[0], tileLayout{tileW: 300, tileH: 300})
+			if err != nil {
+				t.Fatal(err)
+			}
+			objs, _ := wrapTileContents(100, pages, [][]*page{ts})
+			trim := ts[0].trimBox
+			for _, tile := range ts {
+				trim = trim.union(tile.trimBox)
+				want := []int{tile.contentIds[0], 4, 101}
+				if !reflect.DeepEqual(tile.contentIds, want) {
+					t.Errorf("tile %s has contents %v, want %v", tileLabel(tile), tile.contentIds, want)
+				}
+				if got := testStream(t, objs, tile.contentIds[0]); got != tt.start {
+					t.Errorf("tile %s starts with %q, want %q", tileLabel(tile), got, tt.start)
+				}
+			}
+			if trim != tt.trimBox {
+				t.Errorf("tiles cover %v, want %v", trim, tt.trimBox)
+			}
+		})
+	}
+}
+
+// testPage returns a page with all of its boxes set to r.
+func testPage(r rect) *page {
+	return &page{number: 1, mediaBox: r, cropBox: r, bleedBox: r, trimBox: r}
+}
+
+// testGrid returns the labels of the tiles of a page as they are laid
+// out, from the top row down.
+func testGrid(ts []*page) []string {
+	grid := make([][]string, ts[0].vTiles)
+	for i := range grid {
+		grid[i] = make([]string, ts[0].hTiles)
+	}
+	for _, t := range ts {
+		grid[t.vTiles-1-t.tileY][t.tileX] = tileLabel(t)
+	}
+	rows := make([]string, len(grid))
+	for i, r := range grid {
+		rows[i] = strings.Join(r, " ")
+	}
+	return rows
+}
+
+func TestTileLabelsOfMapAndTiles(t *testing.T) {
+	p := testPage(rect{0, 0, 400, 300})
+	bleed := margins{bleedMargin, bleedMargin, bleedMargin, bleedMargin}
+	ts, err := cutPageToTiles(p, tileLayout{tileW: 100, tileH: 100, bleed: bleed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"C1 C2 C3 C4",
+		"B1 B2 B3 B4",
+		"A1 A2 A3 A4",
+	}
+	if got := testGrid(ts); !reflect.DeepEqual(got, want) {
+		t.Fatalf("tiles are labelled %q, want %q", got, want)
+	}
+	_, m := createAssemblyMapForPage(1, p, ts, 595, 842)
+	for _, tile := range ts {
+		row, col := tileRef(tile)
+		if !strings.Contains(m, "cm "+strToVecChars(row+col, 0, 0)) {
+			t.Errorf("map has no label %s", row+col)
+		}
+		o := createOverlayForPage(2, tile)
+		if !strings.Contains(o, strToVecChars(row, -1, 1)) || !strings.Contains(o, strToVecChars(col, 1, -1)) {
+			t.Errorf("tile %s isn't labelled %s and %s", row+col, row, col)
+		}
+	}
+}
+
+func TestGetAllPagesOrder(t *testing.T) {
+	pg := testDict("/Contents [ ]", "/MediaBox [ 0 0 100 100 ]", "/Parent 2 0 R", "/Type /Page")
+	catalog := testDict("/Pages 2 0 R", "/Type /Catalog")
+	tests := []struct {
+		name string
+		objs []string
+		want []int
+	}{
+		{
+			name: "flat",
+			objs: []string{catalog, testDict("/Count 3", "/Kids [ 3 0 R 4 0 R 5 0 R ]", "/Type /Pages"), pg, pg, pg},
+			want: []int{3, 4, 5},
+		},
+		{
+			name: "kids out of file order",
+			objs: []string{catalog, testDict("/Count 3", "/Kids [ 5 0 R 3 0 R 4 0 R ]", "/Type /Pages"), pg, pg, pg},
+			want: []int{5, 3, 4},
+		},
+		{
+			name: "two levels",
+			objs: []string{
+				catalog,
+				testDict("/Count 3", "/Kids [ 3 0 R 4 0 R ]", "/Type /Pages"),
+				testDict("/Count 2", "/Kids [ 6 0 R 5 0 R ]", "/Parent 2 0 R", "/Type /Pages"),
+				testDict("/Count 1", "/Kids [ 7 0 R ]", "/Parent 2 0 R", "/Type /Pages"),
+				pg, pg, pg,
+			},
+			want: []int{6, 5, 7},
+		},
+		{
+			name: "page missing from the tree",
+			objs: []string{catalog, testDict("/Count 2", "/Kids [ 4 0 R 3 0 R ]", "/Type /Pages"), pg, pg, pg},
+			want: []int{3, 4, 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int
+			for i, p := range getAllPages(testQDF(tt.objs...)) {
+				if p.number != i+1 {
+					t.Errorf("page %d is numbered %d", p.id, p.number)
+				}
+				got = append(got, p.id)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pages are %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOverlayLongTitle(t *testing.T) {
+	defer func(title string, wrap bool) {
+		*tileTitle, *titleWrap = title, wrap
+	}(*tileTitle, *titleWrap)
+	*tileTitle = "A VERY LONG TITLE TAKEN FROM THE FILE NAME OF THE POSTER"
+
+	bleed := margins{bleedMargin, bleedMargin, bleedMargin, bleedMargin}
+	ts, err := cutPageToTiles(testPage(rect{0, 0, 200, 200}), tileLayout{tileW: 100, tileH: 100, bleed: bleed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb := ts[0].trimBox
+	titleW := tb.urx - tb.llx - vecCharHeight
+	tests := []struct {
+		wrap  bool
+		lines int
+	}{
+		{false, 1},
+		{true, 2},
+	}
+	for _, tt := range tests {
+		*titleWrap = tt.wrap
+		lines := []string{truncateVecChars(*tileTitle, titleW)}
+		if tt.wrap {
+			lines = wrapVecChars(*tileTitle, titleW, 2)
+		}
+		if len(lines) != tt.lines {
+			t.Fatalf("-title-wrap=%t: title is on %d lines, want %d", tt.wrap, len(lines), tt.lines)
+		}
+		if !strings.HasSuffix(lines[len(lines)-1], "...") {
+			t.Errorf("-title-wrap=%t: title %q isn't cut short", tt.wrap, lines)
+		}
+		o := createOverlayForPage(1, ts[0])
+		for _, l := range lines {
+			if vecCharsWidth(l) > titleW {
+				t.Errorf("-title-wrap=%t: line %q is wider than the tile", tt.wrap, l)
+			}
+			if !strings.Contains(o, strToVecChars(l, 1, -1)) {
+				t.Errorf("-title-wrap=%t: tile has no title line %q", tt.wrap, l)
+			}
+		}
+		if strings.Contains(o, strToVecChars(*tileTitle, 1, -1)) {
+			t.Errorf("-title-wrap=%t: tile has the whole title", tt.wrap)
+		}
+	}
+}
+
+// testObject returns what's between the header of object id of d and
+// its endobj.
+func testObject(t *testing.T, d string, id int) string {
+	t.Helper()
+	m := regexp.MustCompile(fmt.Sprintf(`(?ms)^%d 0 obj\n(.*?)^endobj`, id)).FindStringSubmatch(d)
+	if m == nil {
+		t.Fatalf("no object %d", id)
+	}
+	return m[1]
+}
+
+func TestFlattenPageTree(t *testing.T) {
+	catalog := testDict("/Pages 2 0 R", "/Type /Catalog")
+	type want struct {
+		id       int
+		mediaBox rect
+		rotate   int
+	}
+	tests := []struct {
+		name  string
+		objs  []string
+		pages []want
+		nulls []int
+	}{
+		{
+			name: "flat",
+			objs: []string{
+				catalog,
+				testDict("/Count 2", "/Kids [ 4 0 R 3 0 R ]", "/Type /Pages"),
+				testDict("/Contents [ ]", "/MediaBox [ 0 0 100 100 ]", "/Parent 2 0 R", "/Type /Page"),
+				testDict("/Contents [ ]", "/MediaBox [ 0 0 200 200 ]", "/Parent 2 0 R", "/Rotate 90", "/Type /Page"),
+			},
+			pages: []want{{4, rect{0, 0, 200, 200}, 90}, {3, rect{0, 0, 100, 100}, 0}},
+		},
+		{
+			name: "nested",
+			objs: []string{
+				catalog,
+				testDict("/Count 3", "/Kids [ 3 0 R 6 0 R ]", "/Type /Pages"),
+				testDict("/Count 2", "/Kids [ 5 0 R 4 0 R ]", "/MediaBox [ 0 0 300 300 ]", "/Parent 2 0 R", "/Rotate 90", "/Type /Pages"),
+				testDict("/Contents [ ]", "/Parent 3 0 R", "/Type /Page"),
+				testDict("/Contents [ ]", "/Parent 3 0 R", "/Rotate 180", "/Type /Page"),
+				testDict("/Contents [ ]", "/MediaBox [ 0 0 100 100 ]", "/Parent 2 0 R", "/Type /Page"),
+			},
+			pages: []want{{5, rect{0, 0, 300, 300}, 180}, {4, rect{0, 0, 300, 300}, 90}, {6, rect{0, 0, 100, 100}, 0}},
+			nulls: []int{3},
+		},
+		{
+			name: "nested twice",
+			objs: []string{
+				catalog,
+				testDict("/Count 2", "/Kids [ 3 0 R ]", "/Type /Pages"),
+				testDict("/Count 2", "/Kids [ 4 0 R ]", "/MediaBox [ 0 0 300 300 ]", "/Parent 2 0 R", "/Rotate 90", "/Type /Pages"),
+				testDict("/Count 2", "/Kids [ 5 0 R 6 0 R ]", "/Parent 3 0 R", "/Rotate 270", "/Type /Pages"),
+				testDict("/Contents [ ]", "/Parent 4 0 R", "/Type /Page"),
+				testDict("/Contents [ ]", "/MediaBox [ 0 0 100 100 ]", "/Parent 4 0 R", "/Type /Page"),
+			},
+			pages: []want{{5, rect{0, 0, 300, 300}, 270}, {6, rect{0, 0, 100, 100}, 270}},
+			nulls: []int{3, 4},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := flattenPageTree(testQDF(tt.objs...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			root := testObject(t, d, 2)
+			var kids []int
+			for _, ref := range regexp.MustCompile(`(\d+) 0 R`).FindAllStringSubmatch(root, -1) {
+				id, _ := strconv.Atoi(ref[1])
+				kids = append(kids, id)
+			}
+			var wantKids []int
+			for _, w := range tt.pages {
+				wantKids = append(wantKids, w.id)
+			}
+			if !reflect.DeepEqual(kids, wantKids) {
+				t.Errorf("root has kids %v, want %v", kids, wantKids)
+			}
+			if c := fmt.Sprintf("/Count %d\n", len(tt.pages)); !strings.Contains(root, c) {
+				t.Errorf("root has no %q:\n%s", c, root)
+			}
+			for _, id := range tt.nulls {
+				if o := testObject(t, d, id); o != "null\n" {
+					t.Errorf("node %d is left as:\n%s", id, o)
+				}
+			}
+			pages := getAllPages(d)
+			if len(pages) != len(tt.pages) {
+				t.Fatalf("got %d pages, want %d", len(pages), len(tt.pages))
+			}
+			for i, w := range tt.pages {
+				p := pages[i]
+				if p.id != w.id || p.mediaBox != w.mediaBox || p.rotate != w.rotate {
+					t.Errorf("page %d is %d with %v rotated %d, want %d with %v rotated %d",
+						i+1, p.id, p.mediaBox, p.rotate, w.id, w.mediaBox, w.rotate)
+				}
+				if o := testObject(t, d, p.id); strings.Count(o, "/Parent") != 1 || !strings.Contains(o, "/Parent 2 0 R") {
+					t.Errorf("page %d isn't a kid of the root:\n%s", p.id, o)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckPagesFound(t *testing.T) {
+	catalog := testDict("/Pages 2 0 R", "/Type /Catalog")
+	pg := testDict("/Contents [ ]", "/MediaBox [ 0 0 100 100 ]", "/Parent 2 0 R", "/Type /Page")
+	withPages := testQDF(catalog, testDict("/Count 1", "/Kids [ 3 0 R ]", "/Type /Pages"), pg)
+	// Pages qpdf didn't write as pages have no page comments
+	noComments := strings.ReplaceAll(withPages, "%% Page 1\n", "")
+	empty := testQDF(catalog, testDict("/Count 0", "/Kids [ ]", "/Type /Pages"))
+	tests := []struct {
+		name     string
+		data     string
+		numPages int
+		err      bool
+	}{
+		{"pages found", withPages, 1, false},
+		{"no pages found", noComments, 1, true},
+		{"no pages", empty, 0, false},
+	}
+	for _, tt := range tests {
+		if err := checkPagesFound(tt.data, tt.numPages); (err != nil) != tt.err {
+			t.Errorf("%s: checkPagesFound() = %v, want error %t", tt.name, err, tt.err)
+		}
+	}
+
+	// Nor is a document without pages tiled into an empty one
+	if _, _, err := layoutTiles(noComments, optionsFromFlags()); err == nil {
+		t.Error("layoutTiles() of no pages succeeded")
+	}
+}
+
+func TestInsertObjects(t *testing.T) {
+	const obj = "9 0 obj\nnull\nendobj\n"
+	tests := []struct {
+		name string
+		d    string
+		want string
+	}{
+		{
+			name: "one xref",
+			d:    "1 0 obj\nnull\nendobj\nxref\n0 2\ntrailer <<\n>>\nstartxref\n0\n%%EOF\n",
+			want: "1 0 obj\nnull\nendobj\n" + obj + "\nxref\n0 2\ntrailer <<\n>>\nstartxref\n0\n%%EOF\n",
+		},
+		{
+			name: "updated in place",
+			d:    "1 0 obj\nnull\nendobj\nxref\n0 2\ntrailer <<\n>>\n2 0 obj\nnull\nendobj\nxref\n0 3\ntrailer <<\n>>\nstartxref\n0\n%%EOF\n",
+			want: "1 0 obj\nnull\nendobj\nxref\n0 2\ntrailer <<\n>>\n2 0 obj\nnull\nendobj\n" + obj + "\nxref\n0 3\ntrailer <<\n>>\nstartxref\n0\n%%EOF\n",
+		},
+		{
+			name: "xref in a stream",
+			d:    "1 0 obj\n<< /Length 6 >>\nstream\nxref\n\nendstream\nendobj\nxref\n0 2\ntrailer <<\n>>\nstartxref\n0\n%%EOF\n",
+			want: "1 0 obj\n<< /Length 6 >>\nstream\nxref\n\nendstream\nendobj\n" + obj + "\nxref\n0 2\ntrailer <<\n>>\nstartxref\n0\n%%EOF\n",
+		},
+		{
+			name: "no xref",
+			d:    "1 0 obj\nnull\nendobj\ntrailer <<\n>>\nstartxref\n0\n%%EOF\n",
+		},
+		{
+			name: "no startxref",
+			d:    "1 0 obj\nnull\nendobj\nxref\n0 2\ntrailer <<\n>>\n%%EOF\n",
+		},
+	}
+	for _, tt := range tests {
+		got, err := insertObjects(tt.d, obj)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("%s: insertObjects() succeeded", tt.name)
+		case tt.want != "" && err != nil:
+			t.Errorf("%s: insertObjects() failed: %v", tt.name, err)
+		case got != tt.want:
+			t.Errorf("%s: insertObjects() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTileOrigin(t *testing.T) {
+	defer func(origin string) {
+		*tileOrigin = origin
+	}(*tileOrigin)
+	tests := []struct {
+		origin string
+		want   []string
+	}{
+		{"bottom-left", []string{"C1 C2 C3", "B1 B2 B3", "A1 A2 A3"}},
+		{"top-left", []string{"A1 A2 A3", "B1 B2 B3", "C1 C2 C3"}},
+		{"top-right", []string{"A3 A2 A1", "B3 B2 B1", "C3 C2 C1"}},
+		{"bottom-right", []string{"C3 C2 C1", "B3 B2 B1", "A3 A2 A1"}},
+	}
+	for _, tt := range tests {
+		*tileOrigin = tt.origin
+		ts, err := cutPageToTiles(testPage(rect{0, 0, 300, 300}), tileLayout{tileW: 100, tileH: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := testGrid(ts); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-origin %s: tiles are labelled %q, want %q", tt.origin, got, tt.want)
+		}
+		// Tiles come in the order of their labels
+		var labels []string
+		for _, tile := range ts {
+			labels = append(labels, tileLabel(tile))
+		}
+		if want := []string{"A1", "A2", "A3", "B1", "B2", "B3", "C1", "C2", "C3"}; !reflect.DeepEqual(labels, want) {
+			t.Errorf("-origin %s: tiles are in the order %q, want %q", tt.origin, labels, want)
+		}
+	}
+}
+
+func TestWrapTileContentsShared(t *testing.T) {
+	defer func(extend bool) {
+		*extendBleed = extend
+	}(*extendBleed)
+	d := testQDF(
+		testDict("/Pages 2 0 R", "/Type /Catalog"),
+		testDict("/Count 2", "/Kids [ 3 0 R 4 0 R ]", "/Type /Pages"),
+		testDict("/Contents [ 5 0 R 6 0 R ]", "/MediaBox [ 0 0 200 200 ]", "/Parent 2 0 R", "/Type /Page"),
+		testDict("/Contents 6 0 R", "/MediaBox [ 0 0 200 200 ]", "/Parent 2 0 R", "/Type /Page"),
+		testDict("/Length 0"),
+		testDict("/Length 0"),
+	)
+	bleed := margins{bleedMargin, bleedMargin, bleedMargin, bleedMargin}
+	for _, extend := range []bool{false, true} {
+		*extendBleed = extend
+		pages := getAllPages(d)
+		var pageTiles [][]*page
+		for _, p := range pages {
+			ts, err := cutPageToTiles(p, tileLayout{tileW: 100, tileH: 100, bleed: bleed})
+			if err != nil {
+				t.Fatal(err)
+			}
+			pageTiles = append(pageTiles, ts)
+		}
+		objs, _ := wrapTileContents(100, pages, pageTiles)
+		if strings.Contains(objs, "\n6 0 obj") {
+			t.Errorf("-extend-bleed=%t: shared content is rewritten", extend)
+		}
+		for i, ts := range pageTiles {
+			content := pages[i].contentIds
+			for _, tile := range ts {
+				// Each copy of the content is wrapped once
+				ids := tile.contentIds
+				for len(ids) > 0 {
+					n := len(content) + 2
+					if len(ids) < n || ids[0] == 101 || !reflect.DeepEqual(ids[1:n-1], content) || ids[n-1] != 101 {
+						t.Errorf("-extend-bleed=%t: tile %s-%s has contents %v, want %v each wrapped once",
+							extend, pageRef(tile), tileLabel(tile), tile.contentIds, content)
+						break
+					}
+					if s := testStream(t, objs, ids[0]); !strings.HasPrefix(s, "q") {
+						t.Errorf("-extend-bleed=%t: tile %s-%s starts content with %q", extend, pageRef(tile), tileLabel(tile), s)
+					}
+					ids = ids[n:]
+				}
+			}
+		}
+	}
+}
+
+func TestSeamsAtLargeCoordinates(t *testing.T) {
+	tests := []struct {
+		origin  float64
+		overlap float64
+	}{
+		{0, 0},
+		{0, 7.5},
+		{123456.789, 0},
+		{1e7, 0},
+		{1e7, 7.5},
+		{-1e7, 7.5},
+	}
+	for _, tt := range tests {
+		p := testPage(rect{tt.origin, tt.origin, tt.origin + 14400.3, tt.origin + 7200.7})
+		ts, err := cutPageToTiles(p, tileLayout{tileW: 555.5, tileH: 777.7, overlap: tt.overlap})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkTiles(p, ts, tt.overlap); err != nil {
+			t.Errorf("origin %g, overlap %g: %v", tt.origin, tt.overlap, err)
+		}
+		if tt.overlap != 0 {
+			continue
+		}
+		// Edges shared by tiles are written the same
+		grid := map[[2]int]*page{}
+		for _, tile := range ts {
+			grid[[2]int{tile.tileX, tile.tileY}] = tile
+		}
+		for _, tile := range ts {
+			r := tile.trimBox
+			if n := grid[[2]int{tile.tileX + 1, tile.tileY}]; n != nil && pdfNum(r.urx) != pdfNum(n.trimBox.llx) {
+				t.Errorf("origin %g: %s ends at %s but %s starts at %s", tt.origin, tileLabel(tile), pdfNum(r.urx), tileLabel(n), pdfNum(n.trimBox.llx))
+			}
+			if n := grid[[2]int{tile.tileX, tile.tileY + 1}]; n != nil && pdfNum(r.ury) != pdfNum(n.trimBox.lly) {
+				t.Errorf("origin %g: %s ends at %s but %s starts at %s", tt.origin, tileLabel(tile), pdfNum(r.ury), tileLabel(n), pdfNum(n.trimBox.lly))
+			}
+		}
+	}
+}
+
+func TestRemapOpenAction(t *testing.T) {
+	const prefs = "  /ViewerPreferences <<\n    /HideToolbar true\n  >>\n"
+	tests := []struct {
+		name       string
+		openAction string
+		action     string
+		id         int // of the object with the destination
+		want       string
+	}{
+		{"destination", "/OpenAction [ 3 0 R /XYZ null null 0 ]", "null", 1, "  /OpenAction [ 10 0 R /XYZ null null 0 ]\n"},
+		{"destination on lines", "/OpenAction [\n    3 0 R\n    /Fit\n  ]", "null", 1, "  /OpenAction [\n    10 0 R\n    /Fit\n  ]\n"},
+		{"action", "/OpenAction 4 0 R", testDict("/D [ 3 0 R /Fit ]", "/S /GoTo"), 4, "  /D [ 10 0 R /Fit ]\n"},
+		{"page without tiles", "/OpenAction [ 5 0 R /Fit ]", "null", 1, "  /OpenAction [ 5 0 R /Fit ]\n"},
+		{"none", "", "null", 1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := testQDF(
+				testDict(tt.openAction, "/Pages 2 0 R", strings.TrimSpace(prefs), "/Type /Catalog"),
+				testDict("/Count 1", "/Kids [ 3 0 R ]", "/Type /Pages"),
+				testDict("/Contents [ ]", "/MediaBox [ 0 0 100 100 ]", "/Parent 2 0 R", "/Type /Page"),
+				tt.action,
+			)
+			// Page 3 is replaced by its tile 10
+			d = replaceAllDocPagesWith(d, []*page{{id: 10}}, 2)
+			d, err := remapOpenAction(d, map[int]int{3: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := "OpenAction"
+			if tt.id != 1 {
+				key = "D"
+			}
+			if got := getDictEntry(testObject(t, d, tt.id), key); got != tt.want {
+				t.Errorf("destination is %q, want %q", got, tt.want)
+			}
+			if got := getDictEntry(testObject(t, d, 1), "ViewerPreferences"); got != prefs {
+				t.Errorf("viewer preferences are %q, want %q", got, prefs)
+			}
+
+			// -reset-view replaces the open action, leaving the rest
+			if d, err = setCatalogEntry(d, "PageLayout", "/SinglePage"); err != nil {
+				t.Fatal(err)
+			}
+			if d, err = setCatalogEntry(d, "OpenAction", "[ 10 0 R /Fit ]"); err != nil {
+				t.Fatal(err)
+			}
+			catalog := testObject(t, d, 1)
+			if got, want := getDictEntry(catalog, "OpenAction"), "  /OpenAction [ 10 0 R /Fit ]\n"; got != want || strings.Count(catalog, "/OpenAction") != 1 {
+				t.Errorf("-reset-view leaves the catalog as:\n%s", catalog)
+			}
+			if got := getDictEntry(catalog, "ViewerPreferences"); got != prefs {
+				t.Errorf("-reset-view leaves the viewer preferences as %q, want %q", got, prefs)
+			}
+		})
+	}
+}
+
+func TestOutputRotate(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       string // of the landscape page
+		pageRotate int
+		rotate     int
+		skip       bool
+		want       int
+	}{
+		{"none", "1200 800", 0, 0, false, 0},
+		{"output only", "1200 800", 0, 90, false, 90},
+		{"page only", "1200 800", 90, 0, false, 90},
+		{"both", "1200 800", 90, 90, false, 180},
+		{"both round", "1200 800", 270, 180, false, 90},
+		{"counter-clockwise", "1200 800", 0, -90, false, 270},
+		{"undone", "1200 800", 90, -90, false, 0},
+		{"as is", "500 300", 90, 90, true, 180},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rotate := ""
+			if tt.pageRotate != 0 {
+				rotate = fmt.Sprintf("/Rotate %d", tt.pageRotate)
+			}
+			d := testQDF(
+				testDict("/Pages 2 0 R", "/Type /Catalog"),
+				testDict("/Count 1", "/Kids [ 3 0 R ]", "/Type /Pages"),
+				testDict("/Contents [ ]", "/MediaBox [ 0 0 "+tt.size+" ]", "/Parent 2 0 R", rotate, "/Type /Page"),
+			)
+			opts := optionsFromFlags()
+			opts.rotate = tt.rotate
+			opts.skipFitting = tt.skip
+			_, pageTiles, err := layoutTiles(d, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if asIs := pageTiles[0][0].asIs; asIs != tt.skip {
+				t.Fatalf("page is left as is: %t, want %t", asIs, tt.skip)
+			}
+			for _, tile := range pageTiles[0] {
+				if tile.rotate != tt.want {
+					t.Errorf("tile %s is rotated %d, want %d", tileLabel(tile), tile.rotate, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCenterContent(t *testing.T) {
+	tests := []struct {
+		name       string
+		w, h       float64
+		cols, rows int
+		center     bool
+		trimBoxes  []rect
+		content    []bool
+	}{
+		{
+			name: "not padded", w: 200, h: 100, center: true,
+			trimBoxes: []rect{{0, 0, 100, 100}, {100, 0, 200, 100}},
+			content:   []bool{true, true},
+		},
+		{
+			name: "padded", w: 200, h: 100, cols: 4,
+			trimBoxes: []rect{{0, 0, 100, 100}, {100, 0, 200, 100}, {200, 0, 300, 100}, {300, 0, 400, 100}},
+			content:   []bool{true, true, false, false},
+		},
+		{
+			name: "centered", w: 200, h: 100, cols: 4, center: true,
+			trimBoxes: []rect{{-100, 0, 0, 100}, {0, 0, 100, 100}, {100, 0, 200, 100}, {200, 0, 300, 100}},
+			content:   []bool{false, true, true, false},
+		},
+		{
+			name: "centered onto half tiles", w: 200, h: 100, cols: 3, center: true,
+			trimBoxes: []rect{{-50, 0, 50, 100}, {50, 0, 150, 100}, {150, 0, 250, 100}},
+			content:   []bool{true, true, true},
+		},
+		{
+			name: "centered rows", w: 100, h: 100, rows: 3, center: true,
+			trimBoxes: []rect{{0, -100, 100, 0}, {0, 0, 100, 100}, {0, 100, 100, 200}},
+			content:   []bool{false, true, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := tileLayout{tileW: 100, tileH: 100, cols: tt.cols, rows: tt.rows, center: tt.center}
+			ts, err := cutPageToTiles(testPage(rect{0, 0, tt.w, tt.h}), l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var trimBoxes []rect
+			var content []bool
+			for _, tile := range ts {
+				trimBoxes = append(trimBoxes, tile.trimBox)
+				content = append(content, tile.contentIds != nil)
+			}
+			if !reflect.DeepEqual(trimBoxes, tt.trimBoxes) {
+				t.Errorf("tiles have trim boxes %v, want %v", trimBoxes, tt.trimBoxes)
+			}
+			if !reflect.DeepEqual(content, tt.content) {
+				t.Errorf("tiles have content %v, want %v", content, tt.content)
+			}
+		})
+	}
+}
+
+func TestMaxAspect(t *testing.T) {
+	tests := []struct {
+		name       string
+		w, h       float64
+		overlap    float64
+		maxAspect  float64
+		cols, rows int
+	}{
+		{"no limit", 1000, 100, 0, 0, 2, 1},
+		{"wide", 1000, 100, 0, 2, 5, 1},
+		{"wide with a looser limit", 1000, 100, 0, 4, 3, 1},
+		{"tall", 100, 1000, 0, 2, 1, 5},
+		{"square", 1000, 100, 0, 1, 10, 1},
+		{"overlap", 1000, 100, 10, 2, 6, 1},
+		{"within the limit", 1200, 1000, 0, 2, 2, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := tileLayout{tileW: 600, tileH: 600, overlap: tt.overlap, maxAspect: tt.maxAspect}
+			ts, err := cutPageToTiles(testPage(rect{0, 0, tt.w, tt.h}), l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ts[0].hTiles != tt.cols || ts[0].vTiles != tt.rows {
+				t.Errorf("page is cut into %d x %d tiles, want %d x %d", ts[0].hTiles, ts[0].vTiles, tt.cols, tt.rows)
+			}
+			if tt.maxAspect == 0 {
+				return
+			}
+			for _, tile := range ts {
+				tb := tile.trimBox
+				w, h := tb.urx-tb.llx, tb.ury-tb.lly
+				if a := math.Max(w/h, h/w); a > tt.maxAspect+1e-9 {
+					t.Errorf("tile %s is %g x %g, longer than %g times its width", tileLabel(tile), w, h, tt.maxAspect)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkTileDoc tiles a page into 10 x 10 tiles of the default size,
+// writing the output through qpdf in memory.
+func TestSingleTilePage(t *testing.T) {
+	defer func(s string) { *onlyTiles = s }(*onlyTiles)
+	const stream = "q 1 0 0 rg 10 10 80 80 re f Q\n"
+	tests := []struct {
+		name  string
+		box   string
+		tiles string
+		// whether the tile takes the place of the original page
+		inPlace bool
+	}{
+		{"page smaller than a tile", "[ 0 0 100 100 ]", "", true},
+		{"one tile of many", "[ 0 0 4500 6900 ]", "B2", false},
+	}
+	for _, tt := range tests {
+		*onlyTiles = tt.tiles
+		d := testQDF(
+			testDict("/Pages 2 0 R", "/Type /Catalog"),
+			testDict("/Count 1", "/Kids [ 3 0 R ]", "/Type /Pages"),
+			testDict("/Contents 4 0 R", "/MediaBox "+tt.box, "/Parent 2 0 R", "/Resources <<\n  >>", "/Type /Page"),
+			testDict(fmt.Sprintf("/Length %d", len(stream)))+"\nstream\n"+stream+"endstream",
+		)
+		out := filepath.Join(t.TempDir(), "out.pdf")
+		res, err := tileDoc(context.Background(), d, optionsFromFlags(), out, "", "")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if res.Tiles != 1 {
+			t.Fatalf("%s: page is cut into %d tiles, want 1", tt.name, res.Tiles)
+		}
+		b, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d = string(b)
+		kids := regexp.MustCompile(`/Kids \[\s*(\d+) 0 R\s*\]`).FindStringSubmatch(testObject(t, d, 2))
+		if kids == nil {
+			t.Fatalf("%s: page tree has no single kid", tt.name)
+		}
+		o := testObject(t, d, 3)
+		if !tt.inPlace {
+			if kids[1] == "3" || strings.Contains(o, "/TrimBox") {
+				t.Errorf("%s: tile replaces the original page", tt.name)
+			}
+			continue
+		}
+		if kids[1] != "3" {
+			t.Errorf("%s: page tree points at object %s, want 3", tt.name, kids[1])
+		}
+		for _, want := range []string{"/MediaBox [ -72 -72 172 172 ]", "/TrimBox [ 0 0 100 100 ]", "/Parent 2 0 R"} {
+			if !strings.Contains(o, want) {
+				t.Errorf("%s: page has no %s:\n%s", tt.name, want, o)
+			}
+		}
+		// The original content sits between the wrapper's q and Q,
+		// followed by the overlay
+		m := regexp.MustCompile(`/Contents \[\s*(\d+) 0 R\s+4 0 R\s+(\d+) 0 R\s+(\d+) 0 R\s*\]`).FindStringSubmatch(o)
+		if m == nil {
+			t.Fatalf("%s: page contents aren't wrapped:\n%s", tt.name, o)
+		}
+		for i, want := range []string{"q", "Q"} {
+			id, _ := strconv.Atoi(m[i+1])
+			if got := testStream(t, d, id); got != want {
+				t.Errorf("%s: wrapper stream %d is %q, want %q", tt.name, id, got, want)
+			}
+		}
+		id, _ := strconv.Atoi(m[3])
+		if !strings.Contains(testStream(t, d, id), "l S") {
+			t.Errorf("%s: overlay stream %d has no trim marks", tt.name, id)
+		}
+	}
+}
+
+func BenchmarkTileDoc(b *testing.B) {
+	const stream = "q 1 0 0 rg 10 10 4480 6880 re f Q\n"
+	d := testQDF(
+		testDict("/Pages 2 0 R", "/Type /Catalog"),
+		testDict("/Count 1", "/Kids [ 3 0 R ]", "/Type /Pages"),
+		testDict("/Contents 4 0 R", "/MediaBox [ 0 0 4500 6900 ]", "/Parent 2 0 R", "/Resources <<\n  >>", "/Type /Page"),
+		testDict(fmt.Sprintf("/Length %d", len(stream)))+"\nstream\n"+stream+"endstream",
+	)
+	opts := optionsFromFlags()
+	out := filepath.Join(b.TempDir(), "out.pdf")
+	ctx := context.Background()
+	for i := 0; i < b.N; i++ {
+		res, err := tileDoc(ctx, d, opts, out, "", "")
+		if err != nil {
+			b.Fatal(err)
+		}
+		if res.Tiles != 100 {
+			b.Fatalf("page is cut into %d tiles, want 100", res.Tiles)
+		}
+	}
+}
+
+func TestPdfNum(t *testing.T) {
+	tests := []struct {
+		f         float64
+		num, fact string
+	}{
+		{0, "0", "0"},
+		{-0.0001, "0", "-0.0001"},
+		{12, "12", "12"},
+		{0.5, "0.5", "0.5"},
+		{1.0006, "1.001", "1.0006"},
+		{-72.25, "-72.25", "-72.25"},
+		{0.1234567, "0.123", "0.123457"},
+		{10000000.123, "10000000.123", "10000000.123"},
+		{1e7 + 1.0/3, "10000000.333", "10000000.333333"},
+	}
+	for _, tt := range tests {
+		if got := pdfNum(tt.f); got != tt.num {
+			t.Errorf("pdfNum(%g) = %q, want %q", tt.f, got, tt.num)
+		}
+		if got := pdfFactor(tt.f); got != tt.fact {
+			t.Errorf("pdfFactor(%g) = %q, want %q", tt.f, got, tt.fact)
+		}
+	}
+}
+
+func TestCheckTiles(t *testing.T) {
+	p := testPage(rect{0, 0, 300, 200})
+	tests := []struct {
+		name    string
+		move    func(ts []*page)
+		problem string
+	}{
+		{"put together", func(ts []*page) {}, ""},
+		{"gap", func(ts []*page) { ts[1].trimBox.llx += 0.01 }, "gap of"},
+		{"overlap", func(ts []*page) { ts[0].trimBox.urx += 0.01 }, "more than the overlap"},
+		{"out of line", func(ts []*page) { ts[1].trimBox.lly += 0.01 }, "out of line"},
+		{"short of the page", func(ts []*page) { ts[0].trimBox.llx += 0.01 }, "short of the left edge"},
+		{"missing", func(ts []*page) { ts[1].tileX = 5 }, "no tile at column 2 and row 1"},
+	}
+	for _, tt := range tests {
+		ts, err := cutPageToTiles(p, tileLayout{tileW: 100, tileH: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tt.move(ts)
+		err = checkTiles(p, ts, 0)
+		switch {
+		case tt.problem == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.problem != "" && (err == nil || !strings.Contains(err.Error(), tt.problem)):
+			t.Errorf("%s: checkTiles() = %v, want %q", tt.name, err, tt.problem)
+		}
+	}
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"sort"
+	"strings"
+)
+
+// options are the parameters which determine the layout of the tiles.
+type options struct {
+	size        tileSizeFlag
+	orientation string
+	printer     printerFlag
+	overlap     lengthFlag
+	// minimum overlap of pages cut into several tiles
+	minOverlap  lengthFlag
+	trimInset   insetFlag
+	startNumber int
+	rotate      int
+	// width of the glue tabs, zero for no tabs
+	tabWidth lengthFlag
+	// leave pages which fit on the paper as they are
+	skipFitting bool
+	// show the page labels of the input instead of page numbers
+	sourcePageLabels bool
+	// leave out tiles without any content
+	skipBlank bool
+	// scale each page onto a single tile instead of cutting it
+	fitPaper bool
+	// scale each page so its tiles fill the paper
+	fillTile bool
+	// tile sizes of pages by their number in the input, overriding
+	// size
+	pageTileSizes map[int]tileSizeFlag
+	// width and height in mm of the content of a tile below which to warn
+	minContent float64
+	// width of the cuts between tiles to make up for
+	kerf lengthFlag
+	// alternation of tiles with their content turned 180°, "rows" or
+	// "checkerboard", empty for none
+	brick string
+	// references of the only tiles to output, e.g. "A1", all if empty
+	tiles map[string]bool
+	// log the geometry of each page and its tiles
+	summary bool
+	// "odd" or "even" to only tile those pages by their position in the
+	// input, all if empty
+	parity string
+	// pad the grid of tiles of each page to the largest of all pages with
+	// tiles showing none of the page
+	padGrid bool
+	// center pages in their padded grid rather than starting at the
+	// bottom left tile
+	centerContent bool
+	// check the tiles of each page put back together cover it exactly
+	verify bool
+	// longest side of tiles over their shortest above which to cut pages
+	// into more tiles, 0 for no limit
+	maxAspect float64
+}
+
+// optionsFromFlags returns the layout options given on the command line.
+func optionsFromFlags() options {
+	opts := options{
+		size:        tileSizes.sizes[0],
+		orientation: *tileOrientation,
+		printer:     printer,
+		overlap:     tileOverlap,
+		minOverlap:  minOverlap,
+		minContent:  *minContentMM,
+		kerf:        kerf,
+		brick:       *brick,
+		summary:     *showSummary,
+		parity:      *parity,
+		padGrid:     *padGrid,
+		trimInset:   trimInset,
+		startNumber: *startNumber,
+		rotate:      *outputRotate,
+		skipFitting: *skipFitting,
+
+		pageTileSizes:    pageTileSizes.sizes,
+		centerContent:    *centerContent,
+		verify:           *verifyTiles,
+		maxAspect:        *maxAspect,
+		sourcePageLabels: *labelSourcePage,
+		skipBlank:        *skipBlank,
+		fillTile:         *fillTile,
+	}
+	if *tabs {
+		opts.tabWidth = tabWidth
+	}
+	if fitPaper.name != "" {
+		opts.size = fitPaper
+		opts.fitPaper = true
+	}
+	for _, ref := range strings.Split(*onlyTiles, ",") {
+		if ref = strings.ToUpper(strings.TrimSpace(ref)); ref != "" {
+			if opts.tiles == nil {
+				opts.tiles = map[string]bool{}
+			}
+			opts.tiles[ref] = true
+		}
+	}
+	return opts
+}
+
+// paperSize returns the size of the paper of the tiles in pt.
+func (o options) paperSize() (float64, float64) {
+	return o.orientedSize(o.size)
+}
+
+// orientedSize returns the given paper size in pt, turned to the
+// orientation of the tiles.
+func (o options) orientedSize(size tileSizeFlag) (float64, float64) {
+	w := size.width * ptsInInch / mmInInch
+	h := size.height * ptsInInch / mmInInch
+	if (o.orientation == "portrait" && w > h) ||
+		(o.orientation == "landscape" && w < h) {
+		w, h = h, w
+	}
+	return w, h
+}
+
+// tileSize converts the given paper size (which includes margins) in mm
+// to the paper and tile size (which excludes margins) in pt for use with
+// PDF.
+func (o options) tileSize(size tileSizeFlag) (paperW, paperH, tileW, tileH float64, err error) {
+	bleed := o.printer.bleedMargins()
+	paperW, paperH = o.orientedSize(size)
+	tileW = paperW - bleed.left - bleed.right - trimMargin*2
+	tileH = paperH - bleed.top - bleed.bottom - trimMargin*2
+	// Leave room for the tabs so tiles still fit on the paper
+	tileW -= o.tabWidth.pt()
+	tileH -= o.tabWidth.pt()
+	if tileW <= 0 || tileH <= 0 {
+		return 0, 0, 0, 0, fmt.Errorf("tile size is too small for the margins of the printer")
+	}
+	if overlap := o.overlap.pt(); overlap >= tileW || overlap >= tileH {
+		return 0, 0, 0, 0, fmt.Errorf("overlap must be smaller than the tile size excluding margins")
+	}
+	return paperW, paperH, tileW, tileH, nil
+}
+
+// tileLayout returns how pages are cut into tiles of tileW x tileH pt.
+func (o options) tileLayout(tileW, tileH float64) tileLayout {
+	return tileLayout{
+		tileW:       tileW,
+		tileH:       tileH,
+		bleed:       o.printer.bleedMargins(),
+		overlap:     o.overlap.pt(),
+		minOverlap:  o.minOverlap.pt(),
+		minContent:  o.minContent * ptsInInch / mmInInch,
+		kerf:        o.kerf.pt(),
+		maxAspect:   o.maxAspect,
+		skipFitting: o.skipFitting,
+		fill:        o.fillTile,
+		center:      o.centerContent,
+	}
+}
+
+// explainTiles writes to w how the paper of each tile size of opts is
+// taken up by margins, bleed and tabs, and how much of the page each
+// tile shows.
+func explainTiles(w io.Writer, opts options) error {
+	mm := func(pt float64) float64 {
+		return pt * mmInInch / ptsInInch
+	}
+	sizes := []tileSizeFlag{opts.size}
+	pages := make([]int, 0, len(opts.pageTileSizes))
+	for n := range opts.pageTileSizes {
+		pages = append(pages, n)
+	}
+	sort.Ints(pages)
+	for _, n := range pages {
+		sizes = append(sizes, opts.pageTileSizes[n])
+	}
+	bleed := opts.printer.bleedMargins()
+	for i, size := range sizes {
+		paperW, paperH, tileW, tileH, err := opts.tileSize(size)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			fmt.Fprintf(w, "tile size %s:\n", size.String())
+		} else {
+			fmt.Fprintf(w, "tile size %s of page %d:\n", size.String(), pages[i-1])
+		}
+		fmt.Fprintf(w, "  paper       %.1fmm x %.1fmm\n", mm(paperW), mm(paperH))
+		fmt.Fprintf(w, "  margins     %.1fmm top, %.1fmm right, %.1fmm bottom, %.1fmm left, for the marks and labels\n",
+			mm(bleed.top), mm(bleed.right), mm(bleed.bottom), mm(bleed.left))
+		fmt.Fprintf(w, "  bleed       %.1fmm on each side of the trim\n", mm(trimMargin))
+		if tab := opts.tabWidth.pt(); tab > 0 {
+			fmt.Fprintf(w, "  tabs        %.1fmm on the top and right\n", mm(tab))
+		}
+		fmt.Fprintf(w, "  trim        %.1fmm x %.1fmm\n", mm(tileW), mm(tileH))
+		fmt.Fprintf(w, "  content     up to %.1fmm x %.1fmm of the page per tile", mm(tileW), mm(tileH))
+		if overlap := opts.overlap.pt(); overlap > 0 {
+			fmt.Fprintf(w, ", %.1fmm x %.1fmm of it new with %.1fmm overlap", mm(tileW-overlap), mm(tileH-overlap), mm(overlap))
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "  usable      %.1f%% x %.1f%% of the paper, %.1fmm x %.1fmm less\n",
+			tileW/paperW*100, tileH/paperH*100, mm(paperW-tileW), mm(paperH-tileH))
+		switch {
+		case opts.fitPaper:
+			fmt.Fprintf(w, "  pages are scaled to fit the trim, see -summary for the scale of each\n")
+		case opts.fillTile:
+			fmt.Fprintf(w, "  pages are scaled so their tiles fill the trim, see -summary for the scale of each\n")
+		}
+	}
+	return nil
+}
+
+// tilePlan describes where a tile is cut from the pages of the input.
+// Boxes are in pt as llx, lly, urx, ury in the coordinates of the
+// original page, or of the tiles if the page is scaled to fit the paper
+// or to fill the tiles.
+type tilePlan struct {
+	Page     int        `json:"page"`
+	Row      string     `json:"row"`
+	Column   int        `json:"column"`
+	MediaBox [4]float64 `json:"mediaBox"`
+	BleedBox [4]float64 `json:"bleedBox"`
+	TrimBox  [4]float64 `json:"trimBox"`
+	Scale    float64    `json:"scale,omitempty"`
+	Flipped  bool       `json:"flipped,omitempty"`
+}
+
+func (r rect) array() [4]float64 {
+	return [4]float64{r.llx, r.lly, r.urx, r.ury}
+}
+
+// planTiles returns the tiles the PDF read from in would be cut into,
+// for -plan, without creating any of the output.
+func planTiles(in io.Reader, opts options) ([]tilePlan, error) {
+	buf, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	data, err := convertToQDF("input", buf)
+	if err != nil {
+		return nil, err
+	}
+	_, pageTiles, err := layoutTiles(data, opts)
+	if err != nil {
+		return nil, err
+	}
+	var plans []tilePlan
+	for _, ts := range pageTiles {
+		for _, t := range ts {
+			row, _ := tileRef(t)
+			_, col := tileIndex(t)
+			plans = append(plans, tilePlan{
+				Page:     t.number,
+				Row:      row,
+				Column:   col + 1,
+				MediaBox: t.mediaBox.array(),
+				BleedBox: t.bleedBox.array(),
+				TrimBox:  t.trimBox.array(),
+				Scale:    t.scale,
+				Flipped:  t.flipped,
+			})
+		}
+	}
+	return plans, nil
+}
+
+// layoutTiles cuts all the pages of the QDF document into tiles as set
+// by opts. It returns the pages in order along with the tiles of each.
+func layoutTiles(data string, opts options) ([]*page, [][]*page, error) {
+	bleed := opts.printer.bleedMargins()
+	tab := opts.tabWidth.pt()
+	tileSize := opts.tileSize
+	if _, _, _, _, err := tileSize(opts.size); err != nil {
+		return nil, nil, err
+	}
+
+	pages := getAllPages(data)
+	for n := range opts.pageTileSizes {
+		if n > len(pages) {
+			return nil, nil, fmt.Errorf("-tile-sizes has page %d but the input has %d pages", n, len(pages))
+		}
+	}
+
+	// Sort pages by page number if not already sorted
+	sort.Slice(pages, func(i, j int) bool {
+		return pages[i].number < pages[j].number
+	})
+
+	if opts.sourcePageLabels {
+		labels := getSourcePageLabels(data, len(pages))
+		for i, p := range pages {
+			p.label = labels[i]
+		}
+	}
+
+	// Continue page numbering from the given start number
+	for _, p := range pages {
+		p.number += opts.startNumber - 1
+		if opts.trimInset.isSet() {
+			p.trimBox = opts.trimInset.apply(p.mediaBox)
+		}
+	}
+
+	// Pad the grid of each page to the largest of all pages
+	cols, rows := 0, 0
+	if opts.padGrid {
+		for i, p := range pages {
+			if (opts.parity == "odd" && i%2 == 1) || (opts.parity == "even" && i%2 == 0) {
+				continue
+			}
+			size, ok := opts.pageTileSizes[i+1]
+			if !ok {
+				size = opts.size
+			}
+			_, _, tileW, tileH, err := tileSize(size)
+			if err != nil {
+				return nil, nil, fmt.Errorf("page %s: %w", pageRef(p), err)
+			}
+			h, v, _ := tileGrid(p.trimBox.urx-p.trimBox.llx, p.trimBox.ury-p.trimBox.lly, opts.tileLayout(tileW, tileH))
+			if h > cols {
+				cols = h
+			}
+			if v > rows {
+				rows = v
+			}
+		}
+	}
+
+	var kept []*page
+	var pageTiles [][]*page
+	found := map[string]bool{}
+	for i, p := range pages {
+		if (opts.parity == "odd" && i%2 == 1) || (opts.parity == "even" && i%2 == 0) {
+			continue
+		}
+		size, ok := opts.pageTileSizes[i+1]
+		if !ok {
+			size = opts.size
+		}
+		paperW, paperH, tileW, tileH, err := tileSize(size)
+		if err != nil {
+			return nil, nil, fmt.Errorf("page %s: %w", pageRef(p), err)
+		}
+		var ts []*page
+		if opts.fitPaper {
+			t := fitPageToPaper(p, paperW, paperH, bleed, trimMargin)
+			log.Printf("page %s scaled to %.1f%%", pageRef(p), t.scale*100)
+			ts = []*page{t}
+		} else {
+			l := opts.tileLayout(tileW, tileH)
+			l.cols, l.rows = cols, rows
+			ts, err = cutPageToTiles(p, l)
+			if err != nil {
+				return nil, nil, err
+			}
+			if ts[0].scale != 0 {
+				log.Printf("page %s scaled to %.1f%%", pageRef(p), ts[0].scale*100)
+			}
+			if opts.verify && !ts[0].asIs {
+				_, _, o := tileGrid(p.trimBox.urx-p.trimBox.llx, p.trimBox.ury-p.trimBox.lly, l)
+				if err := checkTiles(p, ts, o+l.kerf); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+		if opts.summary {
+			logSummary(p, ts, size, opts)
+		}
+		// A tile of -tiles which turns out blank is still known to exist
+		for _, t := range ts {
+			if ref := tileLabel(t); opts.tiles[ref] {
+				found[ref] = true
+			}
+		}
+		// The extent of the content is in the coordinates of the page,
+		// not of the tiles of a scaled page
+		if opts.skipBlank && ts[0].scale == 0 {
+			if ts = dropBlankTiles(data, p, ts); len(ts) == 0 {
+				log.Printf("skipping blank page %s", pageRef(p))
+				continue
+			}
+		}
+		if opts.tiles != nil {
+			var sel []*page
+			for _, t := range ts {
+				if opts.tiles[tileLabel(t)] {
+					sel = append(sel, t)
+				}
+			}
+			if ts = sel; len(ts) == 0 {
+				continue
+			}
+		}
+		for _, t := range ts {
+			if opts.rotate != 0 {
+				// Turn on from the rotation of the page, which its content
+				// may have been laid out for
+				t.rotate = ((t.rotate+opts.rotate)%360 + 360) % 360
+			}
+			if t.asIs {
+				continue
+			}
+			if t.hTiles*t.vTiles > 1 {
+				row, col := tileIndex(t)
+				switch opts.brick {
+				case "rows":
+					t.flipped = row%2 == 1
+				case "checkerboard":
+					t.flipped = (row+col)%2 == 1
+				}
+			}
+			// Extend the paper beyond the bleed for the tabs
+			edges := tabEdges(t)
+			if tab > 0 && edges&edgeTop != 0 {
+				t.mediaBox.ury += tab
+			}
+			if tab > 0 && edges&edgeRight != 0 {
+				t.mediaBox.urx += tab
+			}
+			t.cropBox = t.mediaBox
+		}
+		kept = append(kept, p)
+		pageTiles = append(pageTiles, ts)
+	}
+	for ref := range opts.tiles {
+		if !found[ref] {
+			return nil, nil, fmt.Errorf("-tiles has %s but no page has such a tile", ref)
+		}
+	}
+	if len(kept) == 0 && opts.tiles != nil {
+		return nil, nil, errors.New("no tiles left to output: the tiles of -tiles are all blank")
+	}
+	if len(kept) == 0 {
+		return nil, nil, errors.New("no tiles left to output")
+	}
+	return kept, pageTiles, nil
+}
+
+// logSummary logs the size of p, the tiles it's cut into and the size of
+// the poster they make up once put together.
+func logSummary(p *page, ts []*page, size tileSizeFlag, opts options) {
+	mm := func(r rect) string {
+		return fmt.Sprintf("%.0fmm x %.0fmm", (r.urx-r.llx)*mmInInch/ptsInInch, (r.ury-r.lly)*mmInInch/ptsInInch)
+	}
+	t := ts[0]
+	if t.asIs {
+		log.Printf("page %s: %s, left as is", pageRef(p), mm(p.trimBox))
+		return
+	}
+	// Tiles overlap, so the poster is as large as their trim boxes
+	// together, which may be scaled or reach beyond the page
+	poster := t.trimBox
+	for _, t := range ts[1:] {
+		poster = poster.union(t.trimBox)
+	}
+	log.Printf("page %s: %s, %d x %d tiles of %s paper with %s overlap, assembles to %s",
+		pageRef(p), mm(p.trimBox), t.hTiles, t.vTiles, size.String(), opts.overlap.String(), mm(poster))
+}
+
+// checkTiles returns an error listing the problems found if the trim
+// boxes of the tiles of p don't make up a grid covering its trim box,
+// with adjacent tiles overlapping by overlap pt.
+func checkTiles(p *page, ts []*page, overlap float64) error {
+	const tolerance = 1e-6 // in pt
+	grid := map[[2]int]*page{}
+	for _, t := range ts {
+		grid[[2]int{t.tileX, t.tileY}] = t
+	}
+	tb := p.trimBox
+	if s := ts[0].scale; s != 0 {
+		tb = rect{tb.llx * s, tb.lly * s, tb.urx * s, tb.ury * s}
+	}
+	var problems []string
+	add := func(format string, a ...interface{}) {
+		problems = append(problems, "  "+fmt.Sprintf(format, a...))
+	}
+	// Compare each tile with the next to the right and above
+	seam := func(t, n *page, overlap, edge0, edge1, side0, side1 float64) {
+		ref := tileLabel(t) + " and " + tileLabel(n)
+		switch d := overlap - (edge0 - edge1); {
+		case d > tolerance:
+			add("gap of %gpt between %s", d, ref)
+		case d < -tolerance:
+			add("%s overlap by %gpt, %gpt more than the overlap", ref, edge0-edge1, -d)
+		}
+		if math.Abs(side0) > tolerance || math.Abs(side1) > tolerance {
+			add("%s are out of line by %gpt and %gpt", ref, side0, side1)
+		}
+	}
+	for x := 0; x < ts[0].hTiles; x++ {
+		for y := 0; y < ts[0].vTiles; y++ {
+			t := grid[[2]int{x, y}]
+			if t == nil {
+				add("no tile at column %d and row %d of the grid", x+1, y+1)
+				continue
+			}
+			r := t.trimBox
+			if n := grid[[2]int{x + 1, y}]; n != nil {
+				seam(t, n, overlap, r.urx, n.trimBox.llx, r.lly-n.trimBox.lly, r.ury-n.trimBox.ury)
+			}
+			if n := grid[[2]int{x, y + 1}]; n != nil {
+				seam(t, n, overlap, r.ury, n.trimBox.lly, r.llx-n.trimBox.llx, r.urx-n.trimBox.urx)
+			}
+			switch {
+			case x == 0 && r.llx > tb.llx+tolerance:
+				add("%s is %gpt short of the left edge of the page", tileLabel(t), r.llx-tb.llx)
+			case x == t.hTiles-1 && r.urx < tb.urx-tolerance:
+				add("%s is %gpt short of the right edge of the page", tileLabel(t), tb.urx-r.urx)
+			}
+			switch {
+			case y == 0 && r.lly > tb.lly+tolerance:
+				add("%s is %gpt short of the bottom edge of the page", tileLabel(t), r.lly-tb.lly)
+			case y == t.vTiles-1 && r.ury < tb.ury-tolerance:
+				add("%s is %gpt short of the top edge of the page", tileLabel(t), tb.ury-r.ury)
+			}
+		}
+	}
+	if problems != nil {
+		return fmt.Errorf("tiles of page %s don't put back together:\n%s", pageRef(p), strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// dropBlankTiles returns the tiles of p which have any of the content of
+// p within their trim box, logging the ones left out. All tiles are
+// kept if the extent of the content can't be worked out.
+func dropBlankTiles(data string, p *page, ts []*page) []*page {
+	bb, err := contentBBox(data, p)
+	if err != nil {
+		return ts
+	}
+	// Tiles don't show content outside the crop box
+	bb = bb.intersect(p.cropBox)
+	var kept []*page
+	for _, t := range ts {
+		r := bb.intersect(t.trimBox)
+		if t.asIs || (r.llx < r.urx && r.lly < r.ury) {
+			kept = append(kept, t)
+			continue
+		}
+		log.Printf("skipping blank tile %s-%s", pageRef(t), tileLabel(t))
+	}
+	return kept
+}
+
+// sheetCutList lists the cuts trimming an output sheet down to the trim box
+// of its tile, in the order to perform them. Sizes are in mm.
+type sheetCutList struct {
+	Sheet  int        `json:"sheet"`
+	Tile   string     `json:"tile"`
+	Width  float64    `json:"width"`
+	Height float64    `json:"height"`
+	Cuts   []sheetCut `json:"cuts"`
+}
+
+// sheetCut is a straight cut across the sheet parallel to one of its edges,
+// at an offset in mm from that edge of the output page as printed.
+type sheetCut struct {
+	Edge   string  `json:"edge"`
+	Offset float64 `json:"offset"`
+}
+
+// sheetCuts returns the cuts of the tile printed on the given output
+// sheet, in the orientation the sheet is printed in. The cuts along the
+// long edges come first so the sheet rests on a long edge while cutting
+// the short ones.
+func sheetCuts(sheet int, t *page) sheetCutList {
+	toMM := func(pt float64) float64 {
+		return pt * mmInInch / ptsInInch
+	}
+	mb, tb := t.mediaBox, t.trimBox
+	// Distances from the top, right, bottom and left edges
+	d := [4]float64{mb.ury - tb.ury, mb.urx - tb.urx, tb.lly - mb.lly, tb.llx - mb.llx}
+	w, h := mb.urx-mb.llx, mb.ury-mb.lly
+	// Each clockwise quarter turn brings the left edge to the top
+	for r := ((t.rotate%360 + 360) % 360) / 90; r > 0; r-- {
+		d = [4]float64{d[3], d[0], d[1], d[2]}
+		w, h = h, w
+	}
+	edges := [4]string{"top", "right", "bottom", "left"}
+	order := []int{3, 1, 0, 2}
+	if w > h {
+		order = []int{0, 2, 3, 1}
+	}
+	row, col := tileRef(t)
+	sc := sheetCutList{
+		Sheet:  sheet,
+		Tile:   fmt.Sprintf("%s-%s%s", pageRef(t), row, col),
+		Width:  toMM(w),
+		Height: toMM(h),
+	}
+	for _, e := range order {
+		if d[e] > 0 {
+			sc.Cuts = append(sc.Cuts, sheetCut{edges[e], toMM(d[e])})
+		}
+	}
+	return sc
+}
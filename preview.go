@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+)
+
+// previewFont is a 3x5 pixel font for the labels of -preview. Each row
+// of a glyph is in the lowest 3 bits, leftmost pixel first.
+var previewFont = map[rune][5]byte{
+	'0': {7, 5, 5, 5, 7}, '1': {2, 6, 2, 2, 7}, '2': {7, 1, 7, 4, 7},
+	'3': {7, 1, 7, 1, 7}, '4': {5, 5, 7, 1, 1}, '5': {7, 4, 7, 1, 7},
+	'6': {7, 4, 7, 5, 7}, '7': {7, 1, 1, 1, 1}, '8': {7, 5, 7, 5, 7},
+	'9': {7, 5, 7, 1, 7}, 'A': {2, 5, 7, 5, 5}, 'B': {6, 5, 6, 5, 6},
+	'C': {3, 4, 4, 4, 3}, 'D': {6, 5, 5, 5, 6}, 'E': {7, 4, 6, 4, 7},
+	'F': {7, 4, 6, 4, 4}, 'G': {3, 4, 5, 5, 3}, 'H': {5, 5, 7, 5, 5},
+	'I': {7, 2, 2, 2, 7}, 'J': {1, 1, 1, 5, 2}, 'K': {5, 5, 6, 5, 5},
+	'L': {4, 4, 4, 4, 7}, 'M': {5, 7, 7, 5, 5}, 'N': {6, 5, 5, 5, 5},
+	'O': {2, 5, 5, 5, 2}, 'P': {6, 5, 6, 4, 4}, 'Q': {2, 5, 5, 6, 3},
+	'R': {6, 5, 6, 5, 5}, 'S': {3, 4, 2, 1, 6}, 'T': {7, 2, 2, 2, 2},
+	'U': {5, 5, 5, 5, 7}, 'V': {5, 5, 5, 5, 2}, 'W': {5, 5, 7, 7, 5},
+	'X': {5, 5, 2, 5, 5}, 'Y': {5, 5, 2, 2, 2}, 'Z': {7, 1, 2, 4, 7},
+	'-': {0, 0, 7, 0, 0},
+}
+
+// drawPreviewLabel draws s in black with its top left corner at x, y,
+// with pixels of the font dot px wide.
+func drawPreviewLabel(img *image.RGBA, s string, x, y, dot int) {
+	for _, c := range s {
+		g := previewFont[c]
+		for row, bits := range g {
+			for col := 0; col < 3; col++ {
+				if bits&(4>>col) == 0 {
+					continue
+				}
+				r := image.Rect(x+col*dot, y+row*dot, x+(col+1)*dot, y+(row+1)*dot)
+				draw.Draw(img, r, image.Black, image.Point{}, draw.Src)
+			}
+		}
+		x += 4 * dot
+	}
+}
+
+// writePreview writes a PNG to name with a thumbnail of each tile, cell
+// px on its longer side, laid out as the tiles of each page are put
+// together and labelled with their reference. Thumbnails are shaded
+// where the content of the page reaches, or all over if its extent
+// can't be worked out.
+func writePreview(data string, pages []*page, pageTiles [][]*page, cell int, name string) error {
+	const gap = 4
+	type thumb struct {
+		t      *page
+		x, y   int
+		scale  float64
+		extent rect
+	}
+	var thumbs []thumb
+	width, height := 0, gap
+	for i, ts := range pageTiles {
+		p, t0 := pages[i], ts[0]
+		tw, th := t0.trimBox.urx-t0.trimBox.llx, t0.trimBox.ury-t0.trimBox.lly
+		scale := float64(cell) / math.Max(tw, th)
+		cw, ch := int(math.Ceil(tw*scale)), int(math.Ceil(th*scale))
+
+		ext, err := contentBBox(data, p)
+		if err != nil {
+			ext = p.mediaBox
+		}
+		ext = ext.intersect(p.cropBox)
+		if t0.scale != 0 {
+			// Bring the extent to the coordinates of the tiles
+			s, tx, ty := t0.scale, t0.offX, t0.offY
+			ext = rect{ext.llx*s + tx, ext.lly*s + ty, ext.urx*s + tx, ext.ury*s + ty}
+		}
+
+		for _, t := range ts {
+			thumbs = append(thumbs, thumb{
+				t:      t,
+				x:      gap + t.tileX*(cw+gap),
+				y:      height + (t.vTiles-1-t.tileY)*(ch+gap),
+				scale:  scale,
+				extent: ext,
+			})
+		}
+		if w := gap + t0.hTiles*(cw+gap); w > width {
+			width = w
+		}
+		height += t0.vTiles*(ch+gap) + gap
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.Gray{0xd0}}, image.Point{}, draw.Src)
+	dot := cell / 48
+	if dot < 1 {
+		dot = 1
+	}
+	for _, th := range thumbs {
+		tb := th.t.trimBox
+		px := func(r rect) image.Rectangle {
+			return image.Rect(
+				th.x+int((r.llx-tb.llx)*th.scale), th.y+int((tb.ury-r.ury)*th.scale),
+				th.x+int(math.Ceil((r.urx-tb.llx)*th.scale)), th.y+int(math.Ceil((tb.ury-r.lly)*th.scale)))
+		}
+		draw.Draw(img, px(tb), image.White, image.Point{}, draw.Src)
+		if c := th.extent.intersect(tb); c.llx < c.urx && c.lly < c.ury {
+			draw.Draw(img, px(c), &image.Uniform{color.Gray{0x90}}, image.Point{}, draw.Src)
+		}
+		drawPreviewLabel(img, tileLabel(th.t), th.x+dot*2, th.y+dot*2, dot)
+	}
+
+	b := &bytes.Buffer{}
+	if err := png.Encode(b, img); err != nil {
+		return err
+	}
+	return writeOutput(name, b.Bytes())
+}
@@ -5,7 +5,11 @@ package qpdf
 // #include <stdlib.h>
 // #include <qpdf/qpdf-c.h>
 import "C"
-import "unsafe"
+import (
+	"io"
+	"io/ioutil"
+	"unsafe"
+)
 
 const (
 	ObjectStreamDisable  = C.qpdf_o_disable
@@ -15,6 +19,11 @@ const (
 	StreamDataUncompress = C.qpdf_s_uncompress
 	StreamDataPreserve   = C.qpdf_s_preserve
 	StreamDataCompress   = C.qpdf_s_compress
+
+	DecodeLevelNone        = C.qpdf_dl_none
+	DecodeLevelGeneralized = C.qpdf_dl_generalized
+	DecodeLevelSpecialized = C.qpdf_dl_specialized
+	DecodeLevelAll         = C.qpdf_dl_all
 )
 
 type qpdfError struct {
@@ -30,6 +39,9 @@ var alreadyClosedError = &qpdfError{"QPDF instance already closed"}
 type QPDF struct {
 	data   C.qpdf_data
 	closed bool
+
+	// buffer given to ReadMemory which QPDF reads from until closed
+	mem unsafe.Pointer
 }
 
 func New() (*QPDF, error) {
@@ -56,6 +68,10 @@ func (q *QPDF) Close() error {
 		return alreadyClosedError
 	}
 	C.qpdf_cleanup(&q.data)
+	if q.mem != nil {
+		C.free(q.mem)
+		q.mem = nil
+	}
 	q.closed = true
 	return nil
 }
@@ -73,6 +89,92 @@ func (q *QPDF) ReadFile(filename string) error {
 	return nil
 }
 
+func (q *QPDF) ReadMemory(description string, buf []byte) error {
+	if q.closed {
+		return alreadyClosedError
+	}
+	if q.mem != nil {
+		C.free(q.mem)
+	}
+	q.mem = C.CBytes(buf)
+	cDescription := C.CString(description)
+	defer C.free(unsafe.Pointer(cDescription))
+	C.qpdf_read_memory(q.data, cDescription, (*C.char)(q.mem), C.ulonglong(len(buf)), nil)
+	if err := q.getError(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReadStream reads the PDF from r, naming it name in errors. The whole
+// stream is read into memory before QPDF parses it, as with ReadMemory.
+func (q *QPDF) ReadStream(name string, r io.Reader) error {
+	if q.closed {
+		return alreadyClosedError
+	}
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return q.ReadMemory(name, buf)
+}
+
+// QPDFVersion returns the version of the QPDF library.
+func (q *QPDF) QPDFVersion() string {
+	return C.GoString(C.qpdf_get_qpdf_version())
+}
+
+// NumberOfPages returns the number of pages of the document read.
+func (q *QPDF) NumberOfPages() (int, error) {
+	if q.closed {
+		return 0, alreadyClosedError
+	}
+	n := int(C.qpdf_get_num_pages(q.data))
+	if err := q.getError(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// GetInfoKey returns the value of key (e.g. /Title) in the document
+// information dictionary, or an empty string if it's not set.
+func (q *QPDF) GetInfoKey(key string) string {
+	if q.closed {
+		return ""
+	}
+	cKey := C.CString(key)
+	defer C.free(unsafe.Pointer(cKey))
+	v := C.qpdf_get_info_key(q.data, cKey)
+	if v == nil {
+		return ""
+	}
+	return C.GoString(v)
+}
+
+func (q *QPDF) SetInfoKey(key, value string) {
+	if q.closed {
+		return
+	}
+	cKey := C.CString(key)
+	defer C.free(unsafe.Pointer(cKey))
+	cValue := C.CString(value)
+	defer C.free(unsafe.Pointer(cValue))
+	C.qpdf_set_info_key(q.data, cKey, cValue)
+}
+
+// SetDeterministicID makes the /ID of the written document depend only
+// on its content, so the same input always gives the same output.
+func (q *QPDF) SetDeterministicID(v bool) {
+	if q.closed {
+		return
+	}
+	var qv C.QPDF_BOOL = C.QPDF_FALSE
+	if v {
+		qv = C.QPDF_TRUE
+	}
+	C.qpdf_set_deterministic_ID(q.data, qv)
+}
+
 func (q *QPDF) SetQDFMode(v bool) {
 	if q.closed {
 		return
@@ -95,6 +197,30 @@ func (q *QPDF) SetCompressStreams(v bool) {
 	C.qpdf_set_compress_streams(q.data, qv)
 }
 
+// SetDecodeLevel sets which filters of streams are decoded when
+// writing, to be written uncompressed or compressed again with Flate as
+// set by SetCompressStreams.
+func (q *QPDF) SetDecodeLevel(v int) {
+	if q.closed {
+		return
+	}
+	C.qpdf_set_decode_level(q.data, C.enum_qpdf_stream_decode_level_e(v))
+}
+
+// SetContentNormalization makes the written content streams have one
+// operator per line and consistent line endings, which is easier to
+// read when they are uncompressed.
+func (q *QPDF) SetContentNormalization(v bool) {
+	if q.closed {
+		return
+	}
+	var qv C.QPDF_BOOL = C.QPDF_FALSE
+	if v {
+		qv = C.QPDF_TRUE
+	}
+	C.qpdf_set_content_normalization(q.data, qv)
+}
+
 func (q *QPDF) SetSuppressWarnings(v bool) {
 	if q.closed {
 		return
@@ -133,6 +259,30 @@ func (q *QPDF) InitFileWrite(filename string) error {
 	return nil
 }
 
+func (q *QPDF) InitWriteMemory() error {
+	if q.closed {
+		return alreadyClosedError
+	}
+	C.qpdf_init_write_memory(q.data)
+	if err := q.getError(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetBuffer returns a copy of the output written by Write after
+// InitWriteMemory. It's copied through a slice of the C buffer as
+// C.GoBytes takes a C int, which would truncate outputs of 2GB or more.
+func (q *QPDF) GetBuffer() []byte {
+	if q.closed {
+		return nil
+	}
+	n := int(C.qpdf_get_buffer_length(q.data))
+	buf := make([]byte, n)
+	copy(buf, unsafe.Slice((*byte)(unsafe.Pointer(C.qpdf_get_buffer(q.data))), n))
+	return buf
+}
+
 func (q *QPDF) Write() error {
 	if q.closed {
 		return alreadyClosedError
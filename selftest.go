@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+)
+
+// selfTestPages are the sizes in pt of the pages of the document tiled
+// by -selftest.
+var selfTestPages = [][2]float64{{1500, 1000}, {700, 2000}}
+
+// selfTestPDF returns a PDF with a page of each of selfTestPages, each
+// filled with a rectangle.
+func selfTestPDF() []byte {
+	objs := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"", // filled in once the ids of the pages are known
+	}
+	var kids string
+	for _, size := range selfTestPages {
+		id := len(objs) + 1
+		kids += fmt.Sprintf(" %d 0 R", id)
+		stream := fmt.Sprintf("0 0 1 rg 10 10 %s %s re f", pdfNum(size[0]-20), pdfNum(size[1]-20))
+		objs = append(objs,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [ 0 0 %s %s ] /Contents %d 0 R /Resources << >> >>", pdfNum(size[0]), pdfNum(size[1]), id+1),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(stream)+1, stream),
+		)
+	}
+	objs[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s ] /Count %d >>", kids, len(selfTestPages))
+
+	b := &bytes.Buffer{}
+	b.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objs))
+	for i, o := range objs {
+		offsets[i] = b.Len()
+		fmt.Fprintf(b, "%d 0 obj\n%s\nendobj\n", i+1, o)
+	}
+	xref := b.Len()
+	fmt.Fprintf(b, "xref\n0 %d\n0000000000 65535 f \n", len(objs)+1)
+	for _, o := range offsets {
+		fmt.Fprintf(b, "%010d 00000 n \n", o)
+	}
+	fmt.Fprintf(b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objs)+1, xref)
+	return b.Bytes()
+}
+
+// runSelfTest tiles a generated document with the default options, then
+// reads the output back and checks it has the expected tiles, boxes and
+// page labels.
+func runSelfTest(ctx context.Context) error {
+	*pageLabels = true
+	*tileTitle = "SELFTEST"
+	opts := optionsFromFlags()
+	opts.verify = true
+
+	data, err := convertToQDF("selftest", selfTestPDF())
+	if err != nil {
+		return fmt.Errorf("can't read the generated input: %w", err)
+	}
+	_, pageTiles, err := layoutTiles(data, opts)
+	if err != nil {
+		return err
+	}
+	var want []*page
+	for _, ts := range pageTiles {
+		want = append(want, ts...)
+	}
+
+	out := filepath.Join(tempDir, "selftest.pdf")
+	if _, err := tileDoc(ctx, data, opts, out, "", ""); err != nil {
+		return fmt.Errorf("can't tile the generated input: %w", err)
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		return err
+	}
+	outData, err := convertToQDF("selftest output", b)
+	if err != nil {
+		return fmt.Errorf("can't read the output back: %w", err)
+	}
+	got := getAllPages(outData)
+	labels := getSourcePageLabels(outData, len(got))
+
+	if len(got) != len(want) {
+		return fmt.Errorf("selftest: output has %d pages, expected %d tiles", len(got), len(want))
+	}
+	near := func(a, b rect) bool {
+		d := []float64{a.llx - b.llx, a.lly - b.lly, a.urx - b.urx, a.ury - b.ury}
+		for _, v := range d {
+			if v < -0.01 || v > 0.01 {
+				return false
+			}
+		}
+		return true
+	}
+	for i, w := range want {
+		g := got[i]
+		ref := pageRef(w) + "-" + tileLabel(w)
+		switch {
+		case !near(g.mediaBox, w.mediaBox):
+			return fmt.Errorf("selftest: tile %s has media box %v, expected %v", ref, g.mediaBox, w.mediaBox)
+		case !near(g.bleedBox, w.bleedBox):
+			return fmt.Errorf("selftest: tile %s has bleed box %v, expected %v", ref, g.bleedBox, w.bleedBox)
+		case !near(g.trimBox, w.trimBox):
+			return fmt.Errorf("selftest: tile %s has trim box %v, expected %v", ref, g.trimBox, w.trimBox)
+		case labels[i] != ref:
+			return fmt.Errorf("selftest: tile %s has page label %q", ref, labels[i])
+		}
+	}
+	log.Printf("selftest passed: %d pages tiled into %d tiles", len(selfTestPages), len(want))
+	return nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"strings"
+	"unicode/utf8"
 )
 
 const (
@@ -318,6 +319,80 @@ c 292.098 6.172 292.34 6.051 292.703 5.914 c 293.23 5.715 l 293.727 5.535
  3.191 l 364.891 2.117 l 360.559 2.117 l 360.559 3.125 l 363.336 7.219 l
  360.648 7.219 l h
 360.648 8.293 m f`,
+	'.': `371.985 3.41 m 373.285 3.41 l 373.285 2.117 l 371.985 2.117 l h
+371.985 3.41 m f`,
+	'-': `381.385 5.566 m 383.885 5.566 l 383.885 4.492 l 381.385 4.492 l h
+381.385 5.566 m f`,
+	':': `391.985 3.41 m 393.285 3.41 l 393.285 2.117 l 391.985 2.117 l h
+391.985 3.41 m f
+391.985 6.766 m 393.285 6.766 l 393.285 5.473 l 391.985 5.473 l h
+391.985 6.766 m f`,
+}
+
+// vecCharsWidth returns the width in pt of s when drawn by
+// strToVecChars.
+func vecCharsWidth(s string) float64 {
+	return float64(utf8.RuneCountInString(s)) * vecCharWidth
+}
+
+// vecCharsHeight returns the height in pt of s when drawn by
+// strToVecChars.
+func vecCharsHeight(s string) float64 {
+	if s == "" {
+		return 0
+	}
+	return vecCharHeight
+}
+
+// truncateVecChars returns s shortened with an ellipsis so that it's no
+// wider than width pt when drawn by strToVecChars.
+func truncateVecChars(s string, width float64) string {
+	if vecCharsWidth(s) <= width {
+		return s
+	}
+	r := []rune(s)
+	for n := len(r) - 1; n > 0; n-- {
+		if t := strings.TrimRight(string(r[:n]), " ") + "..."; vecCharsWidth(t) <= width {
+			return t
+		}
+	}
+	return ""
+}
+
+// wrapVecChars splits s at spaces into at most maxLines lines each no
+// wider than width pt when drawn by strToVecChars. Words which don't fit
+// on the last line are truncated with an ellipsis.
+func wrapVecChars(s string, width float64, maxLines int) []string {
+	var lines []string
+	words := strings.Fields(s)
+	for len(words) > 0 && len(lines) < maxLines-1 {
+		n := 1
+		for n < len(words) && vecCharsWidth(strings.Join(words[:n+1], " ")) <= width {
+			n++
+		}
+		line := strings.Join(words[:n], " ")
+		if vecCharsWidth(line) > width {
+			break // a single word too long, truncate it on the last line
+		}
+		lines = append(lines, line)
+		words = words[n:]
+	}
+	if len(words) > 0 {
+		lines = append(lines, truncateVecChars(strings.Join(words, " "), width))
+	}
+	return lines
+}
+
+// undrawableVecChars returns the characters of s, other than spaces,
+// which strToVecChars leaves blank, each once.
+func undrawableVecChars(s string) string {
+	var u []rune
+	for _, c := range s {
+		if c != ' ' && vecChars[c] == "" && !strings.ContainsRune(string(u), c) {
+			u = append(u, c)
+		}
+	}
+	return string(u)
 }
 
 // strToVecChars returns PDF graphics command stream making up the
@@ -328,34 +403,34 @@ func strToVecChars(s string, hAlign, vAlign int) string {
 	b := &strings.Builder{}
 
 	// alignments
-	var hOff, vOff float32
+	var hOff, vOff float64
 	if hAlign == 0 { // center
-		hOff = float32(len(s)) * vecCharWidth / 2
+		hOff = vecCharsWidth(s) / 2
 	} else if hAlign < 0 { // right
-		hOff = float32(len(s)) * vecCharWidth
+		hOff = vecCharsWidth(s)
 	}
 	if vAlign == 0 { // center
-		vOff = vecCharHeight / 2
+		vOff = vecCharsHeight(s) / 2
 	} else if vAlign < 0 { // bottom
-		vOff = vecCharHeight
+		vOff = vecCharsHeight(s)
 	}
-	b.WriteString(fmt.Sprintf(" q 1 0 0 1 -%f -%f cm ", hOff, vOff))
+	b.WriteString(fmt.Sprintf(" q 1 0 0 1 %s %s cm ", pdfNum(-hOff), pdfNum(-vOff)))
 
-	for i, c := range s {
-		v := vecChars[rune(c)]
+	for i, c := range []rune(s) {
+		v := vecChars[c]
 		if v == "" {
 			continue
 		}
-		b.WriteString(fmt.Sprintf(" q 1 0 0 1 %f 0 cm %s Q ", float32(i)*vecCharWidth, v))
+		b.WriteString(fmt.Sprintf(" q 1 0 0 1 %s 0 cm %s Q ", pdfNum(float64(i)*vecCharWidth), v))
 	}
 	b.WriteString(" Q ")
 	return b.String()
 }
 
 func init() {
-	ci := "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	ci := "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ.-:"
 	for c, v := range vecChars {
-		vecChars[c] = fmt.Sprintf("q %f 0 0 %f 0 0 cm 1 0 0 1 -%d 0 cm %s Q",
-			vecCharScale, vecCharScale, (strings.IndexRune(ci, c)+1)*10, v)
+		vecChars[c] = fmt.Sprintf("q %s 0 0 %s 0 0 cm 1 0 0 1 -%d 0 cm %s Q",
+			pdfNum(vecCharScale), pdfNum(vecCharScale), (strings.IndexRune(ci, c)+1)*10, v)
 	}
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVecCharsWidth(t *testing.T) {
+	tests := []struct {
+		s     string
+		chars int
+	}{
+		{"", 0},
+		{"A", 1},
+		{"A1", 2},
+		{"PAGE 12", 7},
+		{"ÉTÉ", 3},
+	}
+	for _, tt := range tests {
+		if got, want := vecCharsWidth(tt.s), float64(tt.chars)*vecCharWidth; got != want {
+			t.Errorf("vecCharsWidth(%q) = %g, want %g", tt.s, got, want)
+		}
+	}
+
+	// Longer strings are wider
+	s := "TILED POSTER-1 OF 20"
+	for i := 1; i < len(s); i++ {
+		if w0, w1 := vecCharsWidth(s[:i]), vecCharsWidth(s[:i+1]); w1 <= w0 {
+			t.Errorf("vecCharsWidth(%q) = %g, not wider than vecCharsWidth(%q) = %g", s[:i+1], w1, s[:i], w0)
+		}
+	}
+}
+
+func TestVecCharsHeight(t *testing.T) {
+	tests := []struct {
+		s    string
+		want float64
+	}{
+		{"", 0},
+		{"A", vecCharHeight},
+		{"A LONGER TITLE", vecCharHeight},
+	}
+	for _, tt := range tests {
+		if got := vecCharsHeight(tt.s); got != tt.want {
+			t.Errorf("vecCharsHeight(%q) = %g, want %g", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestTruncateVecChars(t *testing.T) {
+	tests := []struct {
+		s     string
+		chars int
+		want  string
+	}{
+		{"SHORT", 10, "SHORT"},
+		{"SHORT", 5, "SHORT"},
+		{"A LONG TITLE", 8, "A LON..."},
+		{"A LONG TITLE", 5, "A..."},
+		{"TITLE", 2, ""},
+	}
+	for _, tt := range tests {
+		if got := truncateVecChars(tt.s, float64(tt.chars)*vecCharWidth); got != tt.want {
+			t.Errorf("truncateVecChars(%q, %d chars) = %q, want %q", tt.s, tt.chars, got, tt.want)
+		}
+	}
+}
+
+func TestWrapVecChars(t *testing.T) {
+	tests := []struct {
+		s     string
+		chars int
+		want  []string
+	}{
+		{"A LONG TITLE", 20, []string{"A LONG TITLE"}},
+		{"A LONG TITLE", 6, []string{"A LONG", "TITLE"}},
+		{"A LONG TITLE HERE", 6, []string{"A LONG", "TIT..."}},
+		{"SUPERCALIFRAGILISTIC WORD", 6, []string{"SUP..."}},
+		{"", 6, nil},
+	}
+	for _, tt := range tests {
+		if got := wrapVecChars(tt.s, float64(tt.chars)*vecCharWidth, 2); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("wrapVecChars(%q, %d chars, 2) = %q, want %q", tt.s, tt.chars, got, tt.want)
+		}
+	}
+}